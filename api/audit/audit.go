@@ -0,0 +1,176 @@
+// Package audit records every user and role mutation of the API to an append-only sink.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"spse-role-poc/api/policy"
+)
+
+// Actions
+const (
+	ActionCreateUser   = "create_user"
+	ActionAddRoles     = "add_roles"
+	ActionRewriteRoles = "rewrite_roles"
+	ActionDeleteUser   = "delete_user"
+)
+
+// Decisions
+const (
+	DecisionAllow = "allow" // the mutation was applied
+	DecisionDeny  = "deny"  // the role policy refused the mutation, see Violations
+	DecisionError = "error" // the mutation was allowed, but the directory failed, see Error
+)
+
+// Unit is an organization unit a role belongs to
+type Unit struct {
+	KLPD        string `json:"klpd"`
+	SatuanKerja string `json:"satuan_kerja"`
+}
+
+// Event is a single entry of the audit log
+type Event struct {
+	Time       time.Time           `json:"time"`
+	RequestID  string              `json:"request_id,omitempty"`
+	Actor      string              `json:"actor"`              // user id of the caller, or "anonymous"
+	Approver   string              `json:"approver,omitempty"` // user id of the second user approving a change of the actor's own roles
+	Operator   bool                `json:"operator,omitempty"` // the actor is an operator, whose request was not checked against the delegation rules
+	Action     string              `json:"action"`
+	Target     string              `json:"target,omitempty"` // user id, empty if a user could not be created
+	Email      string              `json:"email,omitempty"`  // email of the created user
+	Before     []string            `json:"before"`           // roles of the target before the mutation
+	After      []string            `json:"after"`            // roles of the target after the mutation, or the requested ones if denied
+	Decision   string              `json:"decision"`
+	Violations []*policy.Violation `json:"violations,omitempty"`
+	Error      string              `json:"error,omitempty"`
+	Units      []Unit              `json:"units"` // units of the roles in Before and After, to filter by
+
+	// Filled by Chain, see chain.go
+	Seq       int64  `json:"seq,omitempty"`
+	PrevHash  string `json:"prev_hash,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	Signature string `json:"signature,omitempty"`
+
+	raw []byte // the stored form, set by Chain when writing and by the sinks when reading
+}
+
+// Returns the stored form of the event: the one written by Chain, otherwise its JSON encoding
+func (e *Event) encode() ([]byte, error) {
+	if e.raw != nil {
+		return e.raw, nil
+	}
+	return json.Marshal(e)
+}
+
+// Filter selects events; empty fields match any event
+// KLPD and SatuanKerja are codes normalized like policy.NormalizeCode. An event on a
+// KLPD-wide unit (policy.AllSatuanKerja) matches every SatuanKerja of its KLPD.
+type Filter struct {
+	KLPD        string
+	SatuanKerja string
+	Actor       string
+	From        time.Time // inclusive
+	To          time.Time // exclusive
+	Limit       int       // maximum number of events, 0 for DefaultLimit
+}
+
+// DefaultLimit is the number of events returned by a query without limit
+const DefaultLimit = 100
+
+// Match returns true if the event is selected by the filter, ignoring Limit
+func (f *Filter) Match(e *Event) bool {
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.Time.Before(f.To) {
+		return false
+	}
+	if f.KLPD == "" && f.SatuanKerja == "" {
+		return true
+	}
+	for _, unit := range e.Units {
+		if (f.KLPD == "" || unit.KLPD == f.KLPD) && (f.SatuanKerja == "" || unit.SatuanKerja == f.SatuanKerja || unit.SatuanKerja == policy.AllSatuanKerja) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) limit() int {
+	if f.Limit <= 0 {
+		return DefaultLimit
+	}
+	return f.Limit
+}
+
+// Sink stores events. Events can only be appended.
+type Sink interface {
+	Write(e *Event) error
+	// Query returns the newest events selected by f, newest first
+	Query(f Filter) ([]*Event, error)
+	// Scan calls fn for every event, oldest first, until fn returns an error
+	Scan(fn func(e *Event) error) error
+	Close() error
+}
+
+// Open opens the sink of `kind` ("jsonl" or "sqlite") at path, creating it if needed
+func Open(kind, path string) (Sink, error) {
+	switch kind {
+	case "jsonl":
+		return OpenJSONL(path)
+	case "sqlite":
+		return OpenSQLite(path)
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q", kind)
+	}
+}
+
+// ErrReadOnly is returned by Write of a sink opened with OpenReadOnly
+var ErrReadOnly = errors.New("audit log is opened read-only")
+
+// OpenReadOnly opens the existing sink of `kind` at path for reading only, e.g. to verify a
+// copy of the log on a read-only mount. The sink is neither created nor migrated.
+func OpenReadOnly(kind, path string) (Sink, error) {
+	switch kind {
+	case "jsonl":
+		return OpenJSONLReadOnly(path)
+	case "sqlite":
+		return OpenSQLiteReadOnly(path)
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q", kind)
+	}
+}
+
+// UnitsOf returns the units of the roles in rolesets, sorted and without duplicates.
+// Roles which do not follow the naming scheme of policy.RoleName are skipped.
+func UnitsOf(rolesets ...[]string) []Unit {
+	seen := make(map[Unit]bool)
+	units := make([]Unit, 0)
+	for _, roles := range rolesets {
+		for _, role := range roles {
+			name, err := policy.ParseRoleName(role)
+			if err != nil {
+				continue
+			}
+			unit := Unit{KLPD: name.KLPD, SatuanKerja: name.SatuanKerja}
+			if !seen[unit] {
+				seen[unit] = true
+				units = append(units, unit)
+			}
+		}
+	}
+	sort.Slice(units, func(i, j int) bool {
+		if units[i].KLPD != units[j].KLPD {
+			return units[i].KLPD < units[j].KLPD
+		}
+		return units[i].SatuanKerja < units[j].SatuanKerja
+	})
+	return units
+}
@@ -0,0 +1,219 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSink(t *testing.T, sink Sink) {
+	t.Helper()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []*Event{
+		{Time: start, Actor: "auth0|a", Action: ActionCreateUser, Target: "auth0|1", After: []string{"A:A1:PP"}, Decision: DecisionAllow},
+		{Time: start.Add(time.Hour), Actor: "auth0|b", Action: ActionAddRoles, Target: "auth0|1", Before: []string{"A:A1:PP"}, After: []string{"A:A1:PP", "B:A1:PPK"}, Decision: DecisionAllow},
+		{Time: start.Add(2 * time.Hour), Actor: "auth0|a", Action: ActionDeleteUser, Target: "auth0|2", Before: []string{"B:A2:Auditor"}, Decision: DecisionAllow},
+		{Time: start.Add(3 * time.Hour), Actor: "auth0|c", Action: ActionRewriteRoles, Target: "auth0|3", After: []string{"B:*:Admin PPE"}, Decision: DecisionAllow},
+	}
+	for _, e := range events {
+		e.Units = UnitsOf(e.Before, e.After)
+		if err := sink.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		filter Filter
+		want   []string // actions
+	}{
+		{Filter{}, []string{ActionRewriteRoles, ActionDeleteUser, ActionAddRoles, ActionCreateUser}},
+		{Filter{KLPD: "B"}, []string{ActionRewriteRoles, ActionDeleteUser, ActionAddRoles}},
+		// the KLPD-wide role of B is held in every satuan kerja of B
+		{Filter{KLPD: "B", SatuanKerja: "A2"}, []string{ActionRewriteRoles, ActionDeleteUser}},
+		{Filter{KLPD: "A", SatuanKerja: "A2"}, []string{}},
+		{Filter{KLPD: "B", SatuanKerja: "*"}, []string{ActionRewriteRoles}},
+		{Filter{SatuanKerja: "A1"}, []string{ActionRewriteRoles, ActionAddRoles, ActionCreateUser}},
+		{Filter{Actor: "auth0|a"}, []string{ActionDeleteUser, ActionCreateUser}},
+		{Filter{From: start.Add(time.Hour), To: start.Add(2 * time.Hour)}, []string{ActionAddRoles}},
+		// the newest events first
+		{Filter{Limit: 2}, []string{ActionRewriteRoles, ActionDeleteUser}},
+		{Filter{To: start.Add(2 * time.Hour), Limit: 1}, []string{ActionAddRoles}},
+	}
+	for _, test := range tests {
+		got, err := sink.Query(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(test.want) {
+			t.Fatalf("%+v: expected %v, got %d events", test.filter, test.want, len(got))
+		}
+		for i := range got {
+			if got[i].Action != test.want[i] {
+				t.Fatalf("%+v: expected %v, got %s at %d", test.filter, test.want, got[i].Action, i)
+			}
+		}
+	}
+}
+
+func TestJSONLSink(t *testing.T) {
+	sink, err := OpenJSONL(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	testSink(t, sink)
+}
+
+func TestSQLiteSink(t *testing.T) {
+	sink, err := OpenSQLite(filepath.Join(t.TempDir(), "audit.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	testSink(t, sink)
+
+	if _, err := sink.db.Exec(`DELETE FROM events`); err == nil {
+		t.Fatal("expected the audit log to refuse deletes")
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	for _, kind := range []string{"jsonl", "sqlite"} {
+		path := filepath.Join(t.TempDir(), "audit."+kind)
+		if _, err := OpenReadOnly(kind, path); err == nil {
+			t.Fatalf("%s: expected a missing log to be refused", kind)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s: expected the missing log not to be created, got %v", kind, err)
+		}
+
+		sink, err := Open(kind, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, err := NewChain(sink, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := &Event{Time: time.Now().UTC(), Actor: "a", Action: ActionAddRoles, Before: []string{}, After: []string{"A:A1:PP"}, Decision: DecisionAllow}
+		if err := chain.Write(e); err != nil {
+			t.Fatal(err)
+		}
+		sink.Close()
+		if err := os.Chmod(path, 0o400); err != nil {
+			t.Fatal(err)
+		}
+		before, _ := os.ReadFile(path)
+
+		readOnly, err := OpenReadOnly(kind, path)
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		report, err := Verify(readOnly, nil)
+		if err != nil || report.Events != 1 || len(report.Problems) != 0 {
+			t.Fatalf("%s: expected an intact chain, got %+v %v", kind, report, err)
+		}
+		if err := readOnly.Write(e); err != ErrReadOnly {
+			t.Fatalf("%s: expected %v, got %v", kind, ErrReadOnly, err)
+		}
+		readOnly.Close()
+		if after, _ := os.ReadFile(path); string(after) != string(before) {
+			t.Fatalf("%s: expected the log to be unchanged", kind)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	private, public, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ParsePrivateKey(private)
+	pub, _ := ParsePublicKey(public)
+
+	write := func(actors ...string) {
+		sink, err := OpenJSONL(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sink.Close()
+		chain, err := NewChain(sink, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, actor := range actors {
+			e := &Event{Time: time.Now().UTC(), Actor: actor, Action: ActionAddRoles, Before: []string{}, After: []string{"A:A1:PP"}, Decision: DecisionAllow}
+			e.Units = UnitsOf(e.After)
+			if err := chain.Write(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	verify := func() *Report {
+		sink, err := OpenJSONL(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sink.Close()
+		report, err := Verify(sink, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	// the chain continues across restarts
+	write("a", "b")
+	write("c", "d")
+	report := verify()
+	if report.Events != 4 || len(report.Problems) != 0 || report.SignedSeq != 1 || report.Unsigned() != 3 {
+		t.Fatalf("expected an intact chain signed at seq 1, got %+v", report)
+	}
+
+	data, _ := os.ReadFile(path)
+	lines := strings.SplitAfter(string(data), "\n")
+
+	// modifying an event
+	os.WriteFile(path, []byte(strings.Join(lines[:2], "")+strings.Replace(lines[2], `"actor":"c"`, `"actor":"x"`, 1)+lines[3]), 0o600)
+	if report := verify(); len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "seq 3: event was modified") {
+		t.Fatalf("expected the modification to be detected, got %v", report.Problems)
+	}
+
+	// adding a field, which the Event type does not know
+	os.WriteFile(path, []byte(strings.Join(lines[:2], "")+strings.Replace(lines[2], `"actor":"c"`, `"actor":"c","role":"x"`, 1)+lines[3]), 0o600)
+	if report := verify(); len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "seq 3: event was modified") {
+		t.Fatalf("expected the added field to be detected, got %v", report.Problems)
+	}
+
+	// an event written with fields the Event type does not know, e.g. by a later version
+	var last Event
+	json.Unmarshal([]byte(lines[3]), &last)
+	body := fmt.Sprintf(`{"time":"2026-01-01T00:00:00Z","actor":"e","action":"add_roles","before":[],"after":[],"decision":"allow","units":[],"reason":"x","seq":5,"prev_hash":"%s"}`, last.Hash)
+	sum := sha256.Sum256([]byte(body))
+	next := strings.TrimSuffix(body, "}") + `,"hash":"` + hex.EncodeToString(sum[:]) + `"}` + "\n"
+	os.WriteFile(path, append(append([]byte{}, data...), next...), 0o600)
+	if report := verify(); report.Events != 5 || len(report.Problems) != 0 {
+		t.Fatalf("expected the unknown field to be covered by the hash, got %+v", report)
+	}
+
+	// removing an event
+	os.WriteFile(path, []byte(lines[0]+lines[1]+lines[3]), 0o600)
+	if report := verify(); len(report.Problems) != 2 || !strings.Contains(report.Problems[0], "1 events missing") {
+		t.Fatalf("expected the gap to be detected, got %v", report.Problems)
+	}
+
+	// a signature of another key
+	_, other, _ := GenerateKey()
+	pub, _ = ParsePublicKey(other)
+	os.WriteFile(path, data, 0o600)
+	if report := verify(); len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "seq 1: invalid signature") {
+		t.Fatalf("expected the signature to be rejected, got %v", report.Problems)
+	}
+}
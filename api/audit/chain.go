@@ -0,0 +1,199 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// An event is signed once this many events, or this much time, passed since the last signed one
+const (
+	SignEvery    = 100
+	SignInterval = time.Hour
+)
+
+// Chain makes a sink tamper-evident. Every event carries its position in the log (Seq),
+// the hash of the previous event (PrevHash) and its own hash (Hash), which covers every
+// other field. Editing, inserting or removing an event breaks the chain from there on.
+// The hash covers the exact bytes the sink stores, see chainedSuffix, so that events
+// verify regardless of the fields the Event type of the verifier knows.
+// Periodically an event's hash is signed with an Ed25519 key, so that the chain up to it
+// cannot be recomputed by someone without the key. See Verify.
+type Chain struct {
+	Sink
+
+	key ed25519.PrivateKey // nil to only hash
+
+	mu         sync.Mutex
+	seq        int64
+	hash       string
+	signedSeq  int64
+	signedTime time.Time
+}
+
+// NewChain continues the chain of the events already in sink.
+// key may be nil, in which case events are hashed but not signed.
+func NewChain(sink Sink, key ed25519.PrivateKey) (*Chain, error) {
+	c := &Chain{Sink: sink, key: key}
+	err := sink.Scan(func(e *Event) error {
+		c.seq, c.hash = e.Seq, e.Hash
+		if e.Signature != "" {
+			c.signedSeq, c.signedTime = e.Seq, e.Time
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Chain) Write(e *Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.Seq = c.seq + 1
+	e.PrevHash = c.hash
+	e.Hash, e.Signature = "", ""
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	e.Hash = hashOf(body)
+
+	if c.key != nil && (e.Seq-c.signedSeq >= SignEvery || e.Time.Sub(c.signedTime) >= SignInterval) {
+		e.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(c.key, []byte(e.Hash)))
+	}
+	e.raw = chained(body, e.Hash, e.Signature)
+	if err := c.Sink.Write(e); err != nil {
+		return err
+	}
+
+	c.seq, c.hash = e.Seq, e.Hash
+	if e.Signature != "" {
+		c.signedSeq, c.signedTime = e.Seq, e.Time
+	}
+	return nil
+}
+
+// A chained event is stored as its body, the JSON encoding of the event without Hash and Signature,
+// with the members "hash" and, if signed, "signature" appended. Hash is the SHA-256 of the body.
+var chainedSuffix = regexp.MustCompile(`,"hash":"[0-9a-f]+"(,"signature":"[A-Za-z0-9+/=]+")?}$`)
+
+// Returns the stored form of the event with `body`
+func chained(body []byte, hash, signature string) []byte {
+	raw := append([]byte{}, body[:len(body)-1]...)
+	raw = append(raw, `,"hash":"`+hash+`"`...)
+	if signature != "" {
+		raw = append(raw, `,"signature":"`+signature+`"`...)
+	}
+	return append(raw, '}')
+}
+
+// Returns the hex SHA-256 of the body of the event as stored by the sink,
+// or false if it is not stored in the form written by Chain
+func (e *Event) storedHash() (string, bool) {
+	loc := chainedSuffix.FindIndex(e.raw)
+	if loc == nil {
+		return "", false
+	}
+	body := append(append([]byte{}, e.raw[:loc[0]]...), '}')
+	return hashOf(body), true
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Report is the result of Verify
+type Report struct {
+	Events    int64    // number of events
+	SignedSeq int64    // Seq of the last event with a valid signature, 0 if none
+	Problems  []string // empty if the log is intact
+}
+
+// Unsigned returns the number of events after the last signed one. They are chained,
+// but could have been rewritten together with their hashes.
+func (r *Report) Unsigned() int64 {
+	return r.Events - r.SignedSeq
+}
+
+// Verify checks that the events of sink form an unbroken chain starting at Seq 1, that every
+// hash matches its event, and that every signature is valid for pub (signatures are not
+// checked if pub is nil). Verification continues after a problem, so that every broken
+// link is reported.
+func Verify(sink Sink, pub ed25519.PublicKey) (*Report, error) {
+	report := &Report{Problems: make([]string, 0)}
+	problem := func(format string, args ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+
+	var seq int64
+	var hash string
+	err := sink.Scan(func(e *Event) error {
+		report.Events++
+		if e.Hash == "" {
+			problem("event %d (%s) is not chained", report.Events, e.Time.Format(time.RFC3339))
+			seq++
+			return nil
+		}
+
+		if e.Seq != seq+1 {
+			problem("seq %d: expected seq %d, %d events missing or reordered", e.Seq, seq+1, e.Seq-seq-1)
+		}
+		if e.PrevHash != hash {
+			problem("seq %d: previous hash does not match seq %d", e.Seq, seq)
+		}
+		if computed, ok := e.storedHash(); !ok || computed != e.Hash {
+			problem("seq %d: event was modified, hash does not match", e.Seq)
+		}
+		if e.Signature != "" && pub != nil {
+			signature, err := base64.StdEncoding.DecodeString(e.Signature)
+			if err != nil || !ed25519.Verify(pub, []byte(e.Hash), signature) {
+				problem("seq %d: invalid signature", e.Seq)
+			} else {
+				report.SignedSeq = e.Seq
+			}
+		}
+		seq, hash = e.Seq, e.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ParsePrivateKey parses a base64 encoded Ed25519 seed, as printed by GenerateKey
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key must be a base64 encoded %d byte Ed25519 seed", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParsePublicKey parses a base64 encoded Ed25519 public key, as printed by GenerateKey
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be a base64 encoded %d byte Ed25519 key", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// GenerateKey returns a new base64 encoded Ed25519 seed and its public key
+func GenerateKey() (private, public string, err error) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Seed()), base64.StdEncoding.EncodeToString(pub), nil
+}
@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// JSONLSink appends events to a file, one JSON object per line.
+// Queries scan the whole file.
+type JSONLSink struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	readOnly bool
+}
+
+func OpenJSONL(path string) (*JSONLSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLSink{path: path, file: file}, nil
+}
+
+// OpenJSONLReadOnly opens the existing file at path for reading only
+func OpenJSONLReadOnly(path string) (*JSONLSink, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLSink{path: path, file: file, readOnly: true}, nil
+}
+
+func (s *JSONLSink) Write(e *Event) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	line, err := e.encode()
+	if err != nil {
+		return err
+	}
+	line = append(line[:len(line):len(line)], '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *JSONLSink) Query(f Filter) ([]*Event, error) {
+	// the file is scanned oldest first, only the newest f.limit() matches are kept
+	events := make([]*Event, 0)
+	err := s.Scan(func(e *Event) error {
+		if !f.Match(e) {
+			return nil
+		}
+		if len(events) == f.limit() {
+			events = events[1:]
+		}
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+func (s *JSONLSink) Scan(fn func(e *Event) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s:%d: %w", s.path, line, err)
+		}
+		e.raw = append([]byte{}, scanner.Bytes()...)
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *JSONLSink) Close() error {
+	return s.file.Close()
+}
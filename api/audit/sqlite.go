@@ -0,0 +1,198 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"spse-role-poc/api/policy"
+
+	_ "modernc.org/sqlite"
+)
+
+// Updating or deleting events is refused by triggers; the units of an event are
+// stored separately so that queries by KLPD and satuan kerja use an index
+const schema = `
+CREATE TABLE IF NOT EXISTS events (
+	id    INTEGER PRIMARY KEY AUTOINCREMENT,
+	time  INTEGER NOT NULL, -- unix nanoseconds
+	actor TEXT NOT NULL,
+	data  TEXT NOT NULL     -- the event as JSON
+);
+CREATE INDEX IF NOT EXISTS events_time ON events (time);
+CREATE INDEX IF NOT EXISTS events_actor ON events (actor, time);
+
+CREATE TABLE IF NOT EXISTS event_units (
+	event_id     INTEGER NOT NULL REFERENCES events (id),
+	klpd         TEXT NOT NULL,
+	satuan_kerja TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS event_units_unit ON event_units (klpd, satuan_kerja);
+CREATE INDEX IF NOT EXISTS event_units_satuan_kerja ON event_units (satuan_kerja);
+
+CREATE TRIGGER IF NOT EXISTS events_no_update BEFORE UPDATE ON events
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS events_no_delete BEFORE DELETE ON events
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS event_units_no_update BEFORE UPDATE ON event_units
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS event_units_no_delete BEFORE DELETE ON event_units
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+`
+
+// SQLiteSink stores events in a SQLite database
+type SQLiteSink struct {
+	db       *sql.DB
+	readOnly bool
+}
+
+func OpenSQLite(path string) (*SQLiteSink, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes writers, SQLite allows only one at a time anyway
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteSink{db: db}, nil
+}
+
+// OpenSQLiteReadOnly opens the existing database at path for reading only, without running the schema
+func OpenSQLiteReadOnly(path string) (*SQLiteSink, error) {
+	// a missing file is reported as such, SQLite only reports that it cannot open it
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	// characters of the path which have a meaning in URI filenames are escaped
+	escaped := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+	db, err := sql.Open("sqlite", "file:"+escaped+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteSink{db: db, readOnly: true}, nil
+}
+
+func (s *SQLiteSink) Write(e *Event) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	data, err := e.encode()
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO events (time, actor, data) VALUES (?, ?, ?)`, e.Time.UnixNano(), e.Actor, string(data))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, unit := range e.Units {
+		_, err := tx.Exec(`INSERT INTO event_units (event_id, klpd, satuan_kerja) VALUES (?, ?, ?)`, id, unit.KLPD, unit.SatuanKerja)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteSink) Query(f Filter) ([]*Event, error) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	if f.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if !f.From.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, f.From.UnixNano())
+	}
+	if !f.To.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, f.To.UnixNano())
+	}
+	if f.KLPD != "" || f.SatuanKerja != "" {
+		unit := "u.event_id = events.id"
+		if f.KLPD != "" {
+			unit += " AND u.klpd = ?"
+			args = append(args, f.KLPD)
+		}
+		if f.SatuanKerja != "" {
+			unit += " AND u.satuan_kerja IN (?, ?)"
+			args = append(args, f.SatuanKerja, policy.AllSatuanKerja)
+		}
+		where = append(where, "EXISTS (SELECT 1 FROM event_units u WHERE "+unit+")")
+	}
+
+	query := "SELECT data FROM events"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY time DESC, id DESC LIMIT ?"
+	args = append(args, f.limit())
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*Event, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return nil, err
+		}
+		e.raw = []byte(data)
+		events = append(events, &e)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLiteSink) Scan(fn func(e *Event) error) error {
+	rows, err := s.db.Query(`SELECT data FROM events ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return err
+		}
+		e.raw = []byte(data)
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteSink) Close() error {
+	return s.db.Close()
+}
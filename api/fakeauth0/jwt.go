@@ -0,0 +1,79 @@
+package fakeauth0
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Key id of the tenant's signing key in its JWKS
+const signingKeyID = "fake-signing-key"
+
+// RS256 key user access tokens are signed with, generated once and shared by every
+// fake tenant since generating it takes a while
+var (
+	keyOnce sync.Once
+	key     *rsa.PrivateKey
+)
+
+func newSigningKey() *rsa.PrivateKey {
+	keyOnce.Do(func() {
+		var err error
+		if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+	})
+	return key
+}
+
+// Issuer returns the issuer of the user access tokens, e.g. "http://127.0.0.1:1234/"
+func (s *Server) Issuer() string {
+	return s.URL + "/"
+}
+
+// IssueUserToken returns an access token of the user `sub` for `audience`, signed with the
+// tenant's key and valid for `lifetime`. `claims` are added to the token, e.g. a namespaced roles claim.
+func (s *Server) IssueUserToken(sub, audience string, claims map[string]interface{}, lifetime time.Duration) string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: s.signingKey},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", signingKeyID),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	now := time.Now()
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		ID:       randomHex(8),
+		Issuer:   s.Issuer(),
+		Subject:  sub,
+		Audience: jwt.Audience{audience},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(lifetime)),
+	}).Claims(claims).CompactSerialize()
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+func (s *Server) openIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":   s.Issuer(),
+		"jwks_uri": s.URL + "/.well-known/jwks.json",
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &s.signingKey.PublicKey,
+		KeyID:     signingKeyID,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}})
+}
@@ -0,0 +1,85 @@
+package fakeauth0
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client is the machine-to-machine application allowed to request Management API tokens
+type Client struct {
+	ID       string
+	Secret   string
+	Scopes   []string
+	Lifetime time.Duration // lifetime of the issued tokens
+}
+
+// SetClient enables POST /oauth/token for the client credentials grant of c.
+// From then on only tokens issued by the fake tenant are accepted.
+func (s *Server) SetClient(c Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.client = &c
+	s.tokens = make(map[string]time.Time)
+}
+
+// RevokeTokens invalidates every token issued so far, e.g. to simulate a rotated signing key
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]time.Time)
+}
+
+// TokensIssued returns the number of tokens issued so far
+func (s *Server) TokensIssued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issued
+}
+
+func (s *Server) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "", "Missing authentication")
+			return
+		}
+
+		s.mu.Lock()
+		valid := s.client == nil || time.Now().Before(s.tokens[token])
+		s.mu.Unlock()
+		if !valid {
+			writeError(w, http.StatusUnauthorized, "", "Expired token received for JSON Web Token validation")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) issueToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "client_credentials" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil || id != s.client.ID || secret != s.client.Secret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "access_denied", "error_description": "Unauthorized"})
+		return
+	}
+
+	token := "tok_" + randomHex(16)
+	s.tokens[token] = time.Now().Add(s.client.Lifetime)
+	s.issued++
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(s.client.Lifetime.Seconds()),
+		"scope":        strings.Join(s.client.Scopes, " "),
+	})
+}
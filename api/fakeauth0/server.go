@@ -0,0 +1,601 @@
+// Package fakeauth0 is an in-memory stand-in for the subset of the Auth0
+// Management API used by go-auth0 in this project, so integration tests can
+// run without an Auth0 tenant.
+//
+// Supported endpoints (all under /api/v2):
+//
+//	GET    /users                   POST   /users
+//	GET    /users/{id}              DELETE /users/{id}
+//	GET    /users/{id}/roles        POST   /users/{id}/roles   DELETE /users/{id}/roles
+//	GET    /roles                   POST   /roles
+//	GET    /roles/{id}              PATCH  /roles/{id}         DELETE /roles/{id}
+//	GET    /roles/{id}/users
+//
+// List endpoints are paginated with `page` and `per_page` like Auth0. GET /roles/{id}/users
+// also supports checkpoint pagination with `from` and `take`, and like Auth0 returns no more
+// than the first 1000 results (see SetOffsetLimit) with `page` and `per_page`.
+//
+// Tokens for the Management API are issued by POST /oauth/token once a client
+// is registered with SetClient; until then any bearer token is accepted.
+//
+// User access tokens are issued by IssueUserToken, signed with a key published at
+// GET /.well-known/jwks.json, so that the API can validate them locally.
+package fakeauth0
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Auth0 rejects list requests asking for more than 100 items per page
+const maxPerPage = 100
+
+// Auth0 returns no more than the first 1000 users of a role with page and per_page
+const defaultOffsetLimit = 1000
+
+type Role struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type User struct {
+	ID         string `json:"user_id"`
+	Email      string `json:"email"`
+	Connection string `json:"connection,omitempty"`
+
+	password string
+	roles    map[string]bool // set of `role id`
+}
+
+// Server is a fake Auth0 tenant served over HTTP
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	users       map[string]*User
+	roles       map[string]*Role
+	rateLimited int // number of upcoming requests to answer with 429
+	requests    int
+	failures    []failure // upcoming requests to answer with 500
+	latency     time.Duration
+	offsetLimit int // results of GET /roles/{id}/users reachable with page and per_page
+
+	signingKey *rsa.PrivateKey // signs user access tokens
+
+	client *Client              // nil if any bearer token is accepted
+	tokens map[string]time.Time // issued tokens and their expiry
+	issued int
+}
+
+// Starts a new fake tenant with an empty role catalog
+func NewServer() *Server {
+	s := &Server{
+		users:       make(map[string]*User),
+		roles:       make(map[string]*Role),
+		signingKey:  newSigningKey(),
+		offsetLimit: defaultOffsetLimit,
+	}
+
+	r := chi.NewRouter()
+	r.Use(s.countRequests, s.rateLimit, s.fail)
+	r.Post("/oauth/token", s.issueToken)
+	r.Get("/.well-known/openid-configuration", s.openIDConfiguration)
+	r.Get("/.well-known/jwks.json", s.jwks)
+	r.Route("/api/v2", func(r chi.Router) {
+		r.Use(s.requireToken)
+		r.Get("/users", s.listUsers)
+		r.Post("/users", s.createUser)
+		r.Get("/users/{id}", s.readUser)
+		r.Delete("/users/{id}", s.deleteUser)
+		r.Get("/users/{id}/roles", s.userRoles)
+		r.Post("/users/{id}/roles", s.assignRoles)
+		r.Delete("/users/{id}/roles", s.removeRoles)
+
+		r.Get("/roles", s.listRoles)
+		r.Post("/roles", s.createRole)
+		r.Get("/roles/{id}", s.readRole)
+		r.Patch("/roles/{id}", s.updateRole)
+		r.Delete("/roles/{id}", s.deleteRole)
+		r.Get("/roles/{id}/users", s.roleUsers)
+	})
+
+	s.Server = httptest.NewServer(r)
+	return s
+}
+
+// Domain returns the host of the fake tenant, to be used as AUTH0_DOMAIN
+// together with management.WithInsecure()
+func (s *Server) Domain() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// AddRole adds a role to the catalog and returns its id
+func (s *Server) AddRole(name, description string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := "rol_" + randomHex(8)
+	s.roles[id] = &Role{ID: id, Name: name, Description: description}
+	return id
+}
+
+// RateLimit makes the next n requests fail with 429 Too Many Requests
+func (s *Server) RateLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimited = n
+}
+
+type failure struct {
+	method string
+	suffix string
+}
+
+// FailNext makes the next request with `method` whose path ends with `suffix`
+// fail with 500 Internal Server Error, e.g. FailNext("POST", "/roles")
+func (s *Server) FailNext(method, suffix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{method: method, suffix: suffix})
+}
+
+// SetLatency delays every response by d, to widen race windows in tests
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Requests returns the number of requests received so far, including rate limited ones
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		latency := s.latency
+		s.mu.Unlock()
+		time.Sleep(latency)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		limited := s.rateLimited > 0
+		if limited {
+			s.rateLimited--
+		}
+		s.mu.Unlock()
+
+		if limited {
+			// reset immediately so that clients retry without waiting
+			w.Header().Set("X-RateLimit-Limit", "10")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Unix(), 10))
+			writeError(w, http.StatusTooManyRequests, "too_many_requests", "Global limit has been reached")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) fail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		failed := false
+		for i, f := range s.failures {
+			if r.Method == f.method && strings.HasSuffix(r.URL.Path, f.suffix) {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+				failed = true
+				break
+			}
+		}
+		s.mu.Unlock()
+
+		if failed {
+			writeError(w, http.StatusInternalServerError, "", "Internal Server Error")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	users := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	writePage(w, r, "users", users)
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Connection string `json:"connection"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Invalid request payload JSON format")
+		return
+	}
+	if body.Email == "" || body.Password == "" {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Payload validation error: email and password are required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Email == body.Email {
+			writeError(w, http.StatusConflict, "", "The user already exists.")
+			return
+		}
+	}
+
+	user := &User{
+		ID:         "auth0|" + randomHex(12),
+		Email:      body.Email,
+		Connection: body.Connection,
+		password:   body.Password,
+		roles:      make(map[string]bool),
+	}
+	s.users[user.ID] = user
+	writeJSON(w, http.StatusCreated, user)
+}
+
+func (s *Server) readUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[urlParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "inexistent_user", "The user does not exist.")
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.users, urlParam(r, "id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) userRoles(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	user, ok := s.users[urlParam(r, "id")]
+	if !ok {
+		s.mu.Unlock()
+		writeError(w, http.StatusNotFound, "inexistent_user", "The user does not exist.")
+		return
+	}
+	roles := make([]*Role, 0, len(user.roles))
+	for id := range user.roles {
+		roles = append(roles, s.roles[id])
+	}
+	s.mu.Unlock()
+
+	sortRoles(roles)
+	writePage(w, r, "roles", roles)
+}
+
+func (s *Server) assignRoles(w http.ResponseWriter, r *http.Request) {
+	s.updateUserRoles(w, r, true)
+}
+
+func (s *Server) removeRoles(w http.ResponseWriter, r *http.Request) {
+	s.updateUserRoles(w, r, false)
+}
+
+func (s *Server) updateUserRoles(w http.ResponseWriter, r *http.Request, assign bool) {
+	var body struct {
+		Roles []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Invalid request payload JSON format")
+		return
+	}
+	if len(body.Roles) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Payload validation error: 'Too few items (0), minimum 1'")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[urlParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "inexistent_user", "The user does not exist.")
+		return
+	}
+	for _, id := range body.Roles {
+		if _, ok := s.roles[id]; !ok {
+			writeError(w, http.StatusNotFound, "", "One or more of the roles do not exist.")
+			return
+		}
+	}
+	for _, id := range body.Roles {
+		if assign {
+			user.roles[id] = true
+		} else {
+			delete(user.roles, id)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listRoles(w http.ResponseWriter, r *http.Request) {
+	nameFilter := strings.ToLower(r.URL.Query().Get("name_filter"))
+
+	s.mu.Lock()
+	roles := make([]*Role, 0, len(s.roles))
+	for _, role := range s.roles {
+		if strings.Contains(strings.ToLower(role.Name), nameFilter) {
+			roles = append(roles, role)
+		}
+	}
+	s.mu.Unlock()
+
+	sortRoles(roles)
+	writePage(w, r, "roles", roles)
+}
+
+func (s *Server) createRole(w http.ResponseWriter, r *http.Request) {
+	var role Role
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil || role.Name == "" {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Payload validation error: name is required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.roles {
+		if existing.Name == role.Name {
+			writeError(w, http.StatusConflict, "", "Role name already exists")
+			return
+		}
+	}
+	role.ID = "rol_" + randomHex(8)
+	s.roles[role.ID] = &role
+	writeJSON(w, http.StatusOK, role)
+}
+
+func (s *Server) readRole(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	role, ok := s.roles[urlParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "", "The role does not exist.")
+		return
+	}
+	writeJSON(w, http.StatusOK, role)
+}
+
+func (s *Server) updateRole(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Invalid request payload JSON format")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	role, ok := s.roles[urlParam(r, "id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "", "The role does not exist.")
+		return
+	}
+	if body.Name != nil {
+		role.Name = *body.Name
+	}
+	if body.Description != nil {
+		role.Description = *body.Description
+	}
+	writeJSON(w, http.StatusOK, role)
+}
+
+func (s *Server) deleteRole(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := urlParam(r, "id")
+	if _, ok := s.roles[id]; !ok {
+		writeError(w, http.StatusNotFound, "", "The role does not exist.")
+		return
+	}
+	delete(s.roles, id)
+	for _, user := range s.users {
+		delete(user.roles, id)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) roleUsers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	id := urlParam(r, "id")
+	if _, ok := s.roles[id]; !ok {
+		s.mu.Unlock()
+		writeError(w, http.StatusNotFound, "", "The role does not exist.")
+		return
+	}
+	users := make([]*User, 0)
+	for _, user := range s.users {
+		if user.roles[id] {
+			users = append(users, user)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+
+	query := r.URL.Query()
+	if query.Has("from") || query.Has("take") {
+		writeCheckpoint(w, r, "users", users, func(u *User) string { return u.ID })
+		return
+	}
+	s.mu.Lock()
+	if len(users) > s.offsetLimit {
+		users = users[:s.offsetLimit]
+	}
+	s.mu.Unlock()
+	writePage(w, r, "users", users)
+}
+
+// SetOffsetLimit limits the users of a role reachable with page and per_page to the first n, 1000 by default
+func (s *Server) SetOffsetLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offsetLimit = n
+}
+
+// Writes up to `take` items starting at the item whose id is `from` in the checkpoint envelope
+// {<key>: [...], "next": <id of the following item>}, without "next" on the last page
+func writeCheckpoint[T any](w http.ResponseWriter, r *http.Request, key string, items []T, id func(T) string) {
+	query := r.URL.Query()
+	take := 50
+	if v := query.Get("take"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPerPage {
+			writeError(w, http.StatusBadRequest, "invalid_query_string", "Query validation error: 'take' must be between 1 and 100")
+			return
+		}
+		take = n
+	}
+
+	start := 0
+	if from := query.Get("from"); from != "" {
+		start = sort.Search(len(items), func(i int) bool { return id(items[i]) >= from })
+	}
+	end := start + take
+	if end > len(items) {
+		end = len(items)
+	}
+
+	response := map[string]interface{}{key: items[start:end]}
+	if end < len(items) {
+		response["next"] = id(items[end])
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Writes items[page*per_page : (page+1)*per_page] in the Auth0 list envelope
+// {"start", "limit", "length", "total", <key>: [...]} when include_totals=true,
+// or as a bare array otherwise
+func writePage[T any](w http.ResponseWriter, r *http.Request, key string, items []T) {
+	query := r.URL.Query()
+	page, perPage := 0, 50
+	if v := query.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_query_string", "Query validation error: 'page' must be a non-negative integer")
+			return
+		}
+		page = n
+	}
+	if v := query.Get("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPerPage {
+			writeError(w, http.StatusBadRequest, "invalid_query_string", "Query validation error: 'per_page' must be between 1 and 100")
+			return
+		}
+		perPage = n
+	}
+
+	total := len(items)
+	start := page * perPage
+	end := start + perPage
+	if start > len(items) {
+		start = len(items)
+	}
+	if end > len(items) {
+		end = len(items)
+	}
+	items = items[start:end]
+
+	if query.Get("include_totals") != "true" {
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"start":  start,
+		"limit":  perPage,
+		"length": len(items),
+		"total":  total,
+		key:      items,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Writes an error in the format returned by the Management API
+func writeError(w http.ResponseWriter, status int, errorCode, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"statusCode": status,
+		"error":      http.StatusText(status),
+		"message":    message,
+		"errorCode":  errorCode,
+	})
+}
+
+// go-auth0 path-escapes ids such as "auth0|123", which chi leaves escaped
+func urlParam(r *http.Request, key string) string {
+	value := chi.URLParam(r, key)
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		return unescaped
+	}
+	return value
+}
+
+func sortRoles(roles []*Role) {
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,203 @@
+package manager
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"spse-role-poc/api/policy"
+)
+
+// Header carrying the id of the approval of a change of the assigner's own roles, see ApprovalsHandler
+const ApprovalHeader = "X-Approval-Id"
+
+// How long an approval may be redeemed
+const approvalTTL = 15 * time.Minute
+
+// Approval is the consent of a second user, the approver, to one change of the roles of
+// the user UserID: adding Add and removing Remove. It is redeemed by a single request of
+// UserID making exactly that change, before Expiry.
+type Approval struct {
+	ID       string    `json:"approval_id"`
+	Approver string    `json:"approver"`
+	UserID   string    `json:"user_id"`
+	Add      []string  `json:"add"`
+	Remove   []string  `json:"remove"`
+	Expiry   time.Time `json:"expires_at"`
+	Change   string    `json:"-"` // see changeHash
+}
+
+// ApprovalStore keeps approvals until they are redeemed or expire.
+// MemoryApprovalStore is enough for a single instance of the API; instances sharing a tenant
+// need an ApprovalStore backed by shared storage, like their Locker.
+type ApprovalStore interface {
+	Put(a Approval) error
+	// Get returns the approval `id`; ok is false if there is none or it expired
+	Get(id string) (a Approval, ok bool, err error)
+	// Delete removes the approval `id`; ok is false if it was removed already,
+	// so that only one request redeems it
+	Delete(id string) (ok bool, err error)
+}
+
+// MemoryApprovalStore is an in-process ApprovalStore
+type MemoryApprovalStore struct {
+	mu        sync.Mutex
+	approvals map[string]Approval
+}
+
+func NewMemoryApprovalStore() *MemoryApprovalStore {
+	return &MemoryApprovalStore{approvals: make(map[string]Approval)}
+}
+
+// Stores a and drops the expired approvals
+func (s *MemoryApprovalStore) Put(a Approval) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, approval := range s.approvals {
+		if !now.Before(approval.Expiry) {
+			delete(s.approvals, id)
+		}
+	}
+	s.approvals[a.ID] = a
+	return nil
+}
+
+func (s *MemoryApprovalStore) Get(id string) (Approval, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.approvals[id]
+	if !ok || !time.Now().Before(a.Expiry) {
+		return Approval{}, false, nil
+	}
+	return a, true, nil
+}
+
+func (s *MemoryApprovalStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.approvals[id]
+	delete(s.approvals, id)
+	return ok, nil
+}
+
+// Returns the hash identifying the change of the roles of `uid` adding `add` and removing `remove`,
+// independent of the order of the roles
+func changeHash(uid string, add, remove []string) string {
+	sorted := func(roles []string) []string {
+		roles = append([]string{}, roles...)
+		sort.Strings(roles)
+		return roles
+	}
+	// every part is JSON encoded, so that no role name can be mistaken for a separator
+	data, _ := json.Marshal([]interface{}{uid, sorted(add), sorted(remove)})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Handler for Approvals
+// The approver is the subject of the validated token, whose roles are resolved by middleware.ValidateRoles.
+// Requires `user_id`, and `add` and `remove`, the roles the user is going to add to and remove from their own roles.
+// The approver must be another user, allowed to grant every role of `add` and to remove every role of `remove`.
+// Responds with the approval; the user redeems it by sending its `approval_id` as X-Approval-Id
+// with the request making exactly this change, once, within 15 minutes. See policy.SelfModificationApproval.
+func (s *Service) ApprovalsHandler(w http.ResponseWriter, r *http.Request) {
+	approver := Actor(r)
+	roles, ok := assignerRoles(r)
+	if !ok {
+		WriteError(w, http.StatusUnauthorized, CodeUnauthorized, "Approvals require an authenticated approver")
+		return
+	}
+
+	var body struct {
+		UserID string   `json:"user_id"`
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if body.UserID == "" {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "user_id cannot be empty")
+		return
+	}
+	if len(body.Add) == 0 && len(body.Remove) == 0 {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "add and remove cannot both be empty")
+		return
+	}
+	if body.UserID == approver {
+		WriteError(w, http.StatusForbidden, CodeForbidden, "Action not allowed",
+			selfModification("Action not allowed: the approver must be another user"))
+		return
+	}
+
+	add, errList := s.normalizeRoles(body.Add)
+	if errList != nil {
+		writeViolations(w, errList)
+		return
+	}
+	remove, errList := s.normalizeRoles(body.Remove)
+	if errList != nil {
+		writeViolations(w, errList)
+		return
+	}
+	if errList = s.authorizeDelta(roles, add, remove); errList != nil {
+		WriteError(w, http.StatusForbidden, CodeForbidden, "Action not allowed", errList...)
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		WriteError(w, http.StatusInternalServerError, CodeApprovalError, "Could not issue approval: "+err.Error())
+		return
+	}
+	approval := Approval{
+		ID:       hex.EncodeToString(id),
+		Approver: approver,
+		UserID:   body.UserID,
+		Add:      add,
+		Remove:   remove,
+		Expiry:   time.Now().Add(approvalTTL).UTC(),
+		Change:   changeHash(body.UserID, add, remove),
+	}
+	if err := s.Approvals.Put(approval); err != nil {
+		WriteError(w, http.StatusServiceUnavailable, CodeApprovalError, "Could not store approval: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, approval)
+}
+
+// Redeems the approval of ApprovalHeader for the change of the assigner's own roles `uid`,
+// adding `add` and removing `remove`, and returns the approver.
+// Dry runs only check the approval, so that it can still be redeemed by the actual request.
+func (s *Service) redeemApproval(r *http.Request, uid string, add, remove []string) (string, *policy.Violation) {
+	id := strings.TrimSpace(r.Header.Get(ApprovalHeader))
+	if id == "" {
+		return "", selfModification("Action not allowed: changing your own roles requires the approval of a second user, see POST /v1/approvals, sent as " + ApprovalHeader)
+	}
+	approval, ok, err := s.Approvals.Get(id)
+	if err != nil {
+		return "", selfModification("Action not allowed: the approval is unavailable: " + err.Error())
+	}
+	if !ok {
+		return "", selfModification("Action not allowed: the approval is unknown, expired or already used")
+	}
+	if approval.UserID != uid || approval.Change != changeHash(uid, add, remove) {
+		return "", selfModification("Action not allowed: the approval was given for another change")
+	}
+	if isDryRun(r) {
+		return approval.Approver, nil
+	}
+	if ok, err := s.Approvals.Delete(id); err != nil || !ok {
+		return "", selfModification("Action not allowed: the approval is unknown, expired or already used")
+	}
+	return approval.Approver, nil
+}
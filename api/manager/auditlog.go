@@ -0,0 +1,127 @@
+package manager
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/policy"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+	chimiddleware "github.com/go-chi/chi/middleware"
+)
+
+type contextKey int
+
+const (
+	actorKey contextKey = iota
+	assignerRolesKey
+)
+
+// Actor of requests without an authenticated caller
+const anonymous = "anonymous"
+
+// WithActor returns a copy of ctx carrying the user id of the caller
+func WithActor(ctx context.Context, uid string) context.Context {
+	return context.WithValue(ctx, actorKey, uid)
+}
+
+// Actor returns the user id of the caller: the one set by WithActor, otherwise the
+// subject of the token validated by middleware.EnsureValidToken, otherwise "anonymous"
+func Actor(r *http.Request) string {
+	if uid, ok := r.Context().Value(actorKey).(string); ok && uid != "" {
+		return uid
+	}
+	if claims, ok := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims); ok && claims.RegisteredClaims.Subject != "" {
+		return claims.RegisteredClaims.Subject
+	}
+	return anonymous
+}
+
+// Completes `event` with the request and writes it to s.Audit.
+// The mutation has already happened, so a failing sink is logged and does not fail the request.
+// Dry runs are not recorded.
+func (s *Service) record(r *http.Request, event *audit.Event) {
+	if s.Audit == nil || isDryRun(r) {
+		return
+	}
+	event.Time = time.Now().UTC()
+	event.RequestID = chimiddleware.GetReqID(r.Context())
+	event.Actor = Actor(r)
+	event.Operator = s.isOperator(event.Actor)
+	if event.Before == nil {
+		event.Before = []string{}
+	}
+	if event.After == nil {
+		event.After = []string{}
+	}
+	event.Units = audit.UnitsOf(event.Before, event.After)
+
+	if err := s.Audit.Write(event); err != nil {
+		log.Printf("Error writing audit event %+v: %v", event, err)
+	}
+}
+
+// Records the refused mutation `event` and writes the violations
+func (s *Service) deny(w http.ResponseWriter, r *http.Request, event *audit.Event, violations []*policy.Violation) {
+	event.Decision = audit.DecisionDeny
+	event.Violations = violations
+	s.record(r, event)
+	writeViolations(w, violations)
+}
+
+// Records the failed mutation `event` and writes the error
+func (s *Service) fail(w http.ResponseWriter, r *http.Request, event *audit.Event, err error) {
+	event.Decision = audit.DecisionError
+	event.Error = err.Error()
+	s.record(r, event)
+	writeDirectoryError(w, err)
+}
+
+// Handler for Audit Log queries
+// Accepts the query parameters `klpd`, `satuan_kerja`, `actor`, `from` and `to` (RFC 3339) and `limit`
+// `klpd` and `satuan_kerja` are normalized like the units of roles, e.g. `a` matches the roles of KLPD A
+// Responds with the newest matching events, newest first; older events are reached with `to`
+func (s *Service) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Audit == nil {
+		WriteError(w, http.StatusNotFound, CodeAuditError, "Audit log is disabled")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := audit.Filter{
+		KLPD:        policy.NormalizeCode(query.Get("klpd")),
+		SatuanKerja: policy.NormalizeCode(query.Get("satuan_kerja")),
+		Actor:       query.Get("actor"),
+	}
+	var err error
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "from is not an RFC 3339 time")
+			return
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "to is not an RFC 3339 time")
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 || filter.Limit > 1000 {
+			WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "limit must be between 1 and 1000")
+			return
+		}
+	}
+
+	events, err := s.Audit.Query(filter)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, CodeAuditError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": events})
+}
@@ -0,0 +1,140 @@
+package manager
+
+import (
+	"github.com/auth0/go-auth0"
+	"github.com/auth0/go-auth0/management"
+)
+
+// Note: List only returns by default 50 items per page and maximum 100 per page
+const maxPerPage = 100
+
+// Auth0Directory is a Directory backed by the Auth0 Management API
+type Auth0Directory struct {
+	api *management.Management
+}
+
+func NewAuth0Directory(api *management.Management) *Auth0Directory {
+	return &Auth0Directory{api: api}
+}
+
+func (d *Auth0Directory) CreateUser(email, password string) (string, error) {
+	newUser := &management.User{
+		Connection: auth0.String("Username-Password-Authentication"),
+		Email:      auth0.String(email),
+		Password:   auth0.String(password),
+	}
+	err := d.api.User.Create(newUser)
+	if err != nil {
+		return "", err
+	}
+	return newUser.GetID(), nil
+}
+
+func (d *Auth0Directory) DeleteUser(uid string) error {
+	return d.api.User.Delete(uid)
+}
+
+func (d *Auth0Directory) UserRoles(uid string) ([]Role, error) {
+	roles := make([]Role, 0)
+	for page := 0; ; page++ {
+		rolelist, err := d.api.User.Roles(uid, management.Page(page), management.PerPage(maxPerPage))
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, fromAuth0Roles(rolelist.Roles)...)
+		if !rolelist.HasNext() {
+			return roles, nil
+		}
+	}
+}
+
+func (d *Auth0Directory) AssignRoles(uid string, roles []Role) error {
+	return d.api.User.AssignRoles(uid, toAuth0Roles(roles))
+}
+
+func (d *Auth0Directory) RemoveRoles(uid string, roles []Role) error {
+	return d.api.User.RemoveRoles(uid, toAuth0Roles(roles))
+}
+
+// Fetches every page of the role's users with checkpoint pagination,
+// since Auth0 returns no more than the first 1000 with page and per_page
+func (d *Auth0Directory) RoleUsers(id string) ([]User, error) {
+	users := make([]User, 0)
+	for from := ""; ; {
+		options := []management.RequestOption{management.Take(maxPerPage)}
+		if from != "" {
+			options = append(options, management.From(from))
+		}
+		userlist, err := d.api.Role.Users(id, options...)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range userlist.Users {
+			users = append(users, User{ID: user.GetID(), Email: user.GetEmail()})
+		}
+		if userlist.Next == "" {
+			sortUsers(users)
+			return users, nil
+		}
+		from = userlist.Next
+	}
+}
+
+// Fetches every page of the role catalog
+func (d *Auth0Directory) ListRoles() ([]Role, error) {
+	roles := make([]Role, 0)
+	for page := 0; ; page++ {
+		rolelist, err := d.api.Role.List(management.Page(page), management.PerPage(maxPerPage))
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, fromAuth0Roles(rolelist.Roles)...)
+		if !rolelist.HasNext() {
+			return roles, nil
+		}
+	}
+}
+
+func (d *Auth0Directory) CreateRole(name, description string) (Role, error) {
+	role := &management.Role{
+		Name:        auth0.String(name),
+		Description: auth0.String(description),
+	}
+	err := d.api.Role.Create(role)
+	if err != nil {
+		return Role{}, err
+	}
+	return Role{ID: role.GetID(), Name: role.GetName(), Description: role.GetDescription()}, nil
+}
+
+func (d *Auth0Directory) UpdateRoleDescription(id, description string) error {
+	return d.api.Role.Update(id, &management.Role{
+		Description: auth0.String(description),
+	})
+}
+
+func (d *Auth0Directory) DeleteRole(id string) error {
+	return d.api.Role.Delete(id)
+}
+
+func fromAuth0Roles(roles []*management.Role) []Role {
+	result := make([]Role, 0, len(roles))
+	for _, role := range roles {
+		result = append(result, Role{
+			ID:          role.GetID(),
+			Name:        role.GetName(),
+			Description: role.GetDescription(),
+		})
+	}
+	return result
+}
+
+func toAuth0Roles(roles []Role) []*management.Role {
+	result := make([]*management.Role, 0, len(roles))
+	for _, role := range roles {
+		result = append(result, &management.Role{
+			ID: auth0.String(role.ID),
+		})
+	}
+	return result
+}
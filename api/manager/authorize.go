@@ -0,0 +1,110 @@
+package manager
+
+import (
+	"context"
+	"net/http"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/policy"
+)
+
+// WithAssignerRoles returns a copy of ctx carrying the roles of the assigner,
+// which every role granted or removed by the request is checked against
+func WithAssignerRoles(ctx context.Context, roles []string) context.Context {
+	return context.WithValue(ctx, assignerRolesKey, roles)
+}
+
+// Returns the roles of the assigner set by WithAssignerRoles
+func assignerRoles(r *http.Request) ([]string, bool) {
+	roles, ok := r.Context().Value(assignerRolesKey).([]string)
+	return roles, ok
+}
+
+// Checks the delta of a request changing the roles of the user `uid` (empty for a new user)
+// against the roles of its assigner: every added role must be grantable, and every removed role
+// removable, under the delegation rules.
+// Requests of operators (see Service.Operators) are not checked; other requests without
+// assigner roles (see WithAssignerRoles) are refused.
+// A change of the assigner's own roles which requires approval redeems the approval of the request,
+// whose approver is set on `event`.
+func (s *Service) authorize(r *http.Request, event *audit.Event, uid string, add, remove []string) []*policy.Violation {
+	if s.isOperator(Actor(r)) {
+		return nil
+	}
+	roles, ok := assignerRoles(r)
+	if !ok {
+		return []*policy.Violation{{
+			Code:    policy.CodeGrantDenied,
+			Message: "Action not allowed: the roles of the assigner are unknown",
+		}}
+	}
+	if s.isSelf(r, uid) && s.Policy.SelfModification == policy.SelfModificationApproval {
+		if violations := s.authorizeDelta(roles, add, remove); violations != nil {
+			return violations
+		}
+		approver, v := s.redeemApproval(r, uid, add, remove)
+		if v != nil {
+			return []*policy.Violation{v}
+		}
+		event.Approver = approver
+		return nil
+	}
+	return s.authorizeAs(r, roles, uid, add, remove)
+}
+
+// Checks the delta against the assigner's `roles`. A change of the assigner's own roles is
+// handled as s.Policy.SelfModification says; one which requires approval is refused, since
+// only the request making the change redeems an approval.
+func (s *Service) authorizeAs(r *http.Request, roles []string, uid string, add, remove []string) []*policy.Violation {
+	if s.isSelf(r, uid) {
+		switch s.Policy.SelfModification {
+		case policy.SelfModificationDeny:
+			return []*policy.Violation{selfModification("Action not allowed: assigners may not change their own roles")}
+		case policy.SelfModificationApproval:
+			return []*policy.Violation{selfModification("Action not allowed: changing your own roles requires the approval of a second user, see POST /v1/approvals")}
+		}
+	}
+	return s.authorizeDelta(roles, add, remove)
+}
+
+// Returns true if the request changes the roles of its own assigner
+func (s *Service) isSelf(r *http.Request, uid string) bool {
+	return uid != "" && uid == Actor(r)
+}
+
+// Returns true if the user `uid` is one of s.Operators
+func (s *Service) isOperator(uid string) bool {
+	for _, operator := range s.Operators {
+		if operator != "" && operator == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func selfModification(reason string) *policy.Violation {
+	return &policy.Violation{Code: policy.CodeSelfModification, Message: reason}
+}
+
+func (s *Service) authorizeDelta(roles, add, remove []string) []*policy.Violation {
+	var violations []*policy.Violation
+	for _, rolename := range add {
+		if v := s.Policy.CanGrant(roles, rolename); v != nil {
+			violations = append(violations, v)
+		}
+	}
+	for _, rolename := range remove {
+		if v := s.Policy.CanRevoke(roles, rolename); v != nil {
+			violations = append(violations, v)
+		}
+	}
+	return violations
+}
+
+// Records the unauthorized mutation `event` and writes the violations as a 403 Forbidden
+func (s *Service) forbid(w http.ResponseWriter, r *http.Request, event *audit.Event, violations []*policy.Violation) {
+	event.Decision = audit.DecisionDeny
+	event.Violations = violations
+	s.record(r, event)
+	WriteError(w, http.StatusForbidden, CodeForbidden, "Action not allowed", violations...)
+}
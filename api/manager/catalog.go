@@ -0,0 +1,148 @@
+package manager
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultCatalogTTL is how long the role catalog is served from memory before it is downloaded again
+const DefaultCatalogTTL = 5 * time.Minute
+
+// Metrics of every role catalog, published on /debug/vars as "role_catalog"
+var catalogStats = expvar.NewMap("role_catalog")
+
+func init() {
+	catalogStats.Set("hit_rate", expvar.Func(func() interface{} {
+		hits, misses := statValue("hits"), statValue("misses")
+		if hits+misses == 0 {
+			return 0.0
+		}
+		return float64(hits) / float64(hits+misses)
+	}))
+}
+
+func statValue(key string) int64 {
+	if v, ok := catalogStats.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// Catalog is a Directory which keeps the role catalog of the wrapped Directory in memory,
+// indexed by role name. The catalog is downloaded again once it is older than the TTL,
+// or after it has been invalidated. Creating, updating or deleting a role through the
+// Catalog invalidates it, so provisioning through it is seen by the next lookup.
+type Catalog struct {
+	Directory
+
+	ttl time.Duration
+	now func() time.Time
+
+	mu     sync.Mutex
+	roles  []Role          // sorted by role.Name
+	roleID map[string]Role // maps each `role name` to its role
+	loaded time.Time       // zero if the catalog has to be downloaded
+}
+
+// Wraps dir in a Catalog; a ttl of 0 downloads the catalog on every lookup
+func NewCatalog(dir Directory, ttl time.Duration) *Catalog {
+	return &Catalog{Directory: dir, ttl: ttl, now: time.Now}
+}
+
+// Invalidate forces the next lookup to download the catalog
+func (c *Catalog) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loaded = time.Time{}
+	catalogStats.Add("invalidations", 1)
+}
+
+// Downloads the catalog and rebuilds the index, c.mu must be held
+func (c *Catalog) refresh() error {
+	rolelist, err := c.Directory.ListRoles()
+	if err != nil {
+		return err
+	}
+	sortRoles(rolelist)
+
+	roleID := make(map[string]Role, len(rolelist))
+	for _, role := range rolelist {
+		roleID[role.Name] = role
+	}
+	c.roles, c.roleID, c.loaded = rolelist, roleID, c.now()
+	catalogStats.Add("refreshes", 1)
+	return nil
+}
+
+// Returns true if the catalog in memory may be served, c.mu must be held
+func (c *Catalog) fresh() bool {
+	return !c.loaded.IsZero() && c.now().Sub(c.loaded) < c.ttl
+}
+
+// Refreshes the catalog unless it is fresh, c.mu must be held
+func (c *Catalog) load() error {
+	if c.fresh() {
+		catalogStats.Add("hits", 1)
+		return nil
+	}
+	catalogStats.Add("misses", 1)
+	return c.refresh()
+}
+
+// Lookup returns the role of each rolename, in the same order.
+// Returns an error wrapping ErrRoleNotFound if a rolename is not in the catalog
+func (c *Catalog) Lookup(rolenames []string) ([]Role, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	roles := make([]Role, 0, len(rolenames))
+	for _, rolename := range rolenames {
+		role, ok := c.roleID[rolename]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrRoleNotFound, rolename)
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// Roles returns the whole catalog sorted by role.Name, downloading it only if it is not fresh
+func (c *Catalog) Roles() ([]Role, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return append([]Role{}, c.roles...), nil
+}
+
+// ListRoles always downloads the catalog, so callers which need the current
+// catalog (e.g. provisioning) never see a stale copy, and refreshes the index with it
+func (c *Catalog) ListRoles() ([]Role, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	return append([]Role{}, c.roles...), nil
+}
+
+func (c *Catalog) CreateRole(name, description string) (Role, error) {
+	defer c.Invalidate()
+	return c.Directory.CreateRole(name, description)
+}
+
+func (c *Catalog) UpdateRoleDescription(id, description string) error {
+	defer c.Invalidate()
+	return c.Directory.UpdateRoleDescription(id, description)
+}
+
+func (c *Catalog) DeleteRole(id string) error {
+	defer c.Invalidate()
+	return c.Directory.DeleteRole(id)
+}
@@ -0,0 +1,131 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// Tokens are renewed this long before they expire, so that no request is sent with a token
+// about to expire. Tokens living shorter than this are renewed for every request.
+const tokenRefreshBefore = 5 * time.Minute
+
+// Scopes of the Management API used by Auth0Directory
+var RequiredScopes = []string{
+	"read:users", "create:users", "update:users", "delete:users",
+	"read:roles", "create:roles", "update:roles", "delete:roles",
+	"create:role_members", "delete:role_members",
+}
+
+// clientCredentials requests Management API tokens with the client credentials grant
+// and authenticates the requests sent through it
+type clientCredentials struct {
+	config *clientcredentials.Config
+	base   http.RoundTripper
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+// `issuer` is the tenant URL, e.g. https://{AUTH0_DOMAIN}
+func newClientCredentials(issuer, clientID, clientSecret, audience string) *clientCredentials {
+	return &clientCredentials{
+		config: &clientcredentials.Config{
+			ClientID:       clientID,
+			ClientSecret:   clientSecret,
+			TokenURL:       issuer + "/oauth/token",
+			EndpointParams: map[string][]string{"audience": {audience}},
+		},
+		base: http.DefaultTransport,
+	}
+}
+
+// Returns the current token, or a new one if it expires within tokenRefreshBefore
+func (c *clientCredentials) Token() (*oauth2.Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != nil && time.Until(c.token.Expiry) > tokenRefreshBefore {
+		return c.token, nil
+	}
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: c.base})
+	token, err := c.config.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.token = token
+	return token, nil
+}
+
+// Drops `token` so that the next call to Token requests a new one
+func (c *clientCredentials) invalidate(token *oauth2.Token) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == token {
+		c.token = nil
+	}
+}
+
+// MissingScopes returns the RequiredScopes which are not granted to the client
+func (c *clientCredentials) MissingScopes() ([]string, error) {
+	token, err := c.Token()
+	if err != nil {
+		return nil, err
+	}
+	granted := make(map[string]bool)
+	if scope, ok := token.Extra("scope").(string); ok {
+		for _, s := range strings.Fields(scope) {
+			granted[s] = true
+		}
+	}
+
+	missing := make([]string, 0)
+	for _, scope := range RequiredScopes {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// RoundTrip sends req with the current token. A 401 Unauthorized (e.g. the token was
+// revoked before it expired) is retried once with a new token.
+func (c *clientCredentials) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		r := req.Clone(req.Context())
+		r.Header.Set("Authorization", token.Type()+" "+token.AccessToken)
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		res, err := c.base.RoundTrip(r)
+		if err != nil || res.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return res, err
+		}
+		res.Body.Close()
+		c.invalidate(token)
+	}
+}
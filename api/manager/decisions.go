@@ -0,0 +1,128 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"spse-role-poc/api/policy"
+)
+
+// Maximum number of questions of a single decision request
+const maxDecisions = 100
+
+// Decisions
+const (
+	DecisionAllow = "allow"
+	DecisionDeny  = "deny"
+)
+
+// A question of POST /v1/decisions: may the caller grant `role` to the user `user_id`?
+// Without `user_id` the question is asked for a new user without roles.
+type decisionItem struct {
+	Role   string `json:"role"`
+	UserID string `json:"user_id,omitempty"`
+}
+
+type decision struct {
+	Role     string              `json:"role"`
+	UserID   string              `json:"user_id,omitempty"`
+	Decision string              `json:"decision"`
+	Reasons  []*policy.Violation `json:"reasons"` // empty if allowed
+}
+
+// Handler for Authorization Decisions
+// The assigner is the subject of the validated token, whose roles are resolved by middleware.ValidateRoles
+// like those of the routes granting roles; requires `items`, a list of
+// {"role": ..., "user_id": ...} as part of the request body
+// Answers every item independently with allow or deny and the reasons of a denial:
+// the delegation rules, the role catalog and the role policy applied to the user's roles
+func (s *Service) DecisionsHandler(w http.ResponseWriter, r *http.Request) {
+	assigner := Actor(r)
+	assignerRoles, ok := assignerRoles(r)
+	if !ok {
+		WriteError(w, http.StatusUnauthorized, CodeUnauthorized, "Decisions require an authenticated assigner")
+		return
+	}
+
+	var body struct {
+		Items []decisionItem `json:"items"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if len(body.Items) == 0 || len(body.Items) > maxDecisions {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "items must contain between 1 and 100 questions")
+		return
+	}
+
+	// roles of the users asked about, fetched once per user
+	userRoles := make(map[string][]string)
+	decisions := make([]decision, 0, len(body.Items))
+	for _, item := range body.Items {
+		reasons := s.decide(r, assignerRoles, item, userRoles)
+		d := decision{Role: item.Role, UserID: item.UserID, Decision: DecisionAllow, Reasons: reasons}
+		if len(reasons) > 0 {
+			d.Decision = DecisionDeny
+		}
+		decisions = append(decisions, d)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"assigner":  assigner,
+		"decisions": decisions,
+	})
+}
+
+// Returns the reasons why the assigner holding `assignerRoles` may not grant item.Role to item.UserID,
+// asking the assigner's own roles as s.Policy.SelfModification says
+func (s *Service) decide(r *http.Request, assignerRoles []string, item decisionItem, userRoles map[string][]string) []*policy.Violation {
+	role, v := s.Policy.ParseRole(item.Role)
+	if v != nil {
+		return []*policy.Violation{v}
+	}
+	rolename := role.String()
+
+	reasons := append(make([]*policy.Violation, 0), s.authorizeAs(r, assignerRoles, item.UserID, []string{rolename}, nil)...)
+	if _, err := s.Catalog.Lookup([]string{rolename}); err != nil {
+		reasons = append(reasons, errorReason(err, rolename))
+	}
+
+	if item.UserID == "" {
+		return reasons
+	}
+	held, ok := userRoles[item.UserID]
+	if !ok {
+		roles, err := s.Dir.UserRoles(item.UserID)
+		if err != nil {
+			return append(reasons, errorReason(err, rolename))
+		}
+		held = s.managedRoles(roles)
+		userRoles[item.UserID] = held
+	}
+	combined := append([]string{}, held...)
+	if !contains(held, rolename) {
+		combined = append(combined, rolename)
+	}
+	return append(reasons, s.Policy.ValidateRoles(combined)...)
+}
+
+// Turns an error of the catalog or the directory into a reason of a denial
+func errorReason(err error, rolename string) *policy.Violation {
+	code := CodeDirectoryError
+	if errors.Is(err, ErrRoleNotFound) {
+		code = CodeRoleNotFound
+	}
+	return &policy.Violation{Code: code, Roles: []string{rolename}, Message: err.Error()}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package manager
+
+// Role is the identity provider's view of a role, e.g. "A:A1:Admin PPE"
+type Role struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// User is the identity provider's view of a user holding a role
+type User struct {
+	ID    string `json:"user_id"`
+	Email string `json:"email,omitempty"`
+}
+
+// Directory is the identity provider which stores users and the role catalog.
+// Handlers only talk to the provider through this interface, so the API can
+// run against Auth0 or fully offline against an in-memory implementation.
+//
+// Note:
+// - UserRoles and ListRoles return roles sorted by role.Name
+// - RoleUsers returns users sorted by user.ID
+type Directory interface {
+	// CreateUser creates a new user and returns its user id
+	CreateUser(email, password string) (string, error)
+	DeleteUser(uid string) error
+
+	UserRoles(uid string) ([]Role, error)
+	AssignRoles(uid string, roles []Role) error
+	RemoveRoles(uid string, roles []Role) error
+	// RoleUsers returns the users holding the role with the given `role id`
+	RoleUsers(id string) ([]User, error)
+
+	// ListRoles returns the role catalog
+	ListRoles() ([]Role, error)
+	CreateRole(name, description string) (Role, error)
+	UpdateRoleDescription(id, description string) error
+	DeleteRole(id string) error
+}
@@ -0,0 +1,30 @@
+package manager
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Returns true if the request asks for a dry run, with `?dry_run=true` or the header `X-Dry-Run: true`.
+// A dry run is authorized, validated and looked up in the catalog like the actual request,
+// but stops before the first mutating call to the directory and is not recorded in the audit log.
+func isDryRun(r *http.Request) bool {
+	for _, value := range []string{r.URL.Query().Get("dry_run"), r.Header.Get("X-Dry-Run")} {
+		if dryRun, err := strconv.ParseBool(value); err == nil && dryRun {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the role set a dry run would result in
+func writeDryRun(w http.ResponseWriter, roles, add, remove []Role) {
+	sortRoles(roles)
+	writeJSON(w, http.StatusOK, rolesResponse{
+		Message: "Dry run, no changes were made",
+		DryRun:  true,
+		Roles:   roleNames(roles),
+		Added:   roleNames(add),
+		Removed: roleNames(remove),
+	})
+}
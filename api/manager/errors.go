@@ -0,0 +1,66 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"spse-role-poc/api/policy"
+)
+
+// Error codes of the JSON error envelope
+const (
+	CodeInvalidRequest  = "invalid_request"  // the request body is missing or malformed
+	CodePolicyViolation = "policy_violation" // the roles violate the role policy, see violations
+	CodeUnauthorized    = "unauthorized"     // the request carries no valid token
+	CodeForbidden       = "forbidden"        // the assigner is not allowed to perform the action
+	CodeRoleNotFound    = "role_not_found"   // a role is not in the role catalog
+	CodeVersionMismatch = "version_mismatch" // If-Match does not match the user's current roles
+	CodeDirectoryError  = "directory_error"  // the identity provider failed
+	CodeAuditError      = "audit_error"      // the audit log is disabled or failed
+	CodeApprovalError   = "approval_error"   // an approval could not be issued
+)
+
+// The JSON error envelope, e.g.
+//
+//	{"error": {"code": "policy_violation", "message": "...", "violations": [{"code": "sod_exclusive", ...}]}}
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code       string              `json:"code"`
+	Message    string              `json:"message"`
+	Violations []*policy.Violation `json:"violations,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// WriteError writes the JSON error envelope with the given status
+func WriteError(w http.ResponseWriter, status int, code, message string, violations ...*policy.Violation) {
+	writeJSON(w, status, errorEnvelope{
+		Error: errorBody{
+			Code:       code,
+			Message:    message,
+			Violations: violations,
+		},
+	})
+}
+
+// Writes violations of the role policy as a 400 Bad Request
+func writeViolations(w http.ResponseWriter, violations []*policy.Violation) {
+	WriteError(w, http.StatusBadRequest, CodePolicyViolation, "Roles violate the role policy", violations...)
+}
+
+// Writes an error returned by the directory or by a catalog lookup
+func writeDirectoryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrRoleNotFound) {
+		WriteError(w, http.StatusBadRequest, CodeRoleNotFound, err.Error())
+		return
+	}
+	WriteError(w, http.StatusInternalServerError, CodeDirectoryError, err.Error())
+}
@@ -0,0 +1,104 @@
+package manager
+
+import (
+	"net/http"
+	"sort"
+)
+
+type grantableRole struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Function    string `json:"function"`
+}
+
+type grantableSatuanKerja struct {
+	Code  string          `json:"code"`
+	Roles []grantableRole `json:"roles"`
+}
+
+type grantableKLPD struct {
+	Code        string                 `json:"code"`
+	SatuanKerja []grantableSatuanKerja `json:"satuan_kerja"`
+}
+
+// Handler for Grantable Roles
+// The assigner is the subject of the validated token, whose roles are resolved by middleware.ValidateRoles
+// Responds with every role of the catalog the assigner may grant, grouped by KLPD and satuan kerja.
+// With the query parameter `user_id`, only roles the user does not hold yet and which are
+// compatible with the user's roles under the role policy are listed; for the assigner's own
+// roles, only as policy.SelfModification allows.
+func (s *Service) GrantableRolesHandler(w http.ResponseWriter, r *http.Request) {
+	assigner := Actor(r)
+	granters, ok := assignerRoles(r)
+	if !ok {
+		WriteError(w, http.StatusUnauthorized, CodeUnauthorized, "Grantable roles require an authenticated assigner")
+		return
+	}
+	catalog, err := s.Catalog.Roles()
+	if err != nil {
+		writeDirectoryError(w, err)
+		return
+	}
+
+	uid := r.URL.Query().Get("user_id")
+	var held []string
+	if uid != "" {
+		roles, err := s.Dir.UserRoles(uid)
+		if err != nil {
+			writeDirectoryError(w, err)
+			return
+		}
+		held = s.managedRoles(roles)
+	}
+
+	grantable := make(map[string]map[string][]grantableRole) // KLPD -> satuan kerja -> roles
+	for _, role := range catalog {
+		name, v := s.Policy.ParseRole(role.Name)
+		if v != nil || len(s.authorizeAs(r, granters, uid, []string{role.Name}, nil)) > 0 {
+			continue
+		}
+		if uid != "" {
+			// the full slice expression makes append copy held
+			combined := append(held[:len(held):len(held)], name.String())
+			if contains(held, name.String()) || len(s.Policy.ValidateRoles(combined)) > 0 {
+				continue
+			}
+		}
+
+		if grantable[name.KLPD] == nil {
+			grantable[name.KLPD] = make(map[string][]grantableRole)
+		}
+		grantable[name.KLPD][name.SatuanKerja] = append(grantable[name.KLPD][name.SatuanKerja], grantableRole{
+			ID:          role.ID,
+			Name:        role.Name,
+			Description: role.Description,
+			Function:    name.Function,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"assigner": assigner,
+		"user_id":  uid,
+		"klpd":     groupGrantable(grantable),
+	})
+}
+
+// Sorts the grouped roles by KLPD and satuan kerja code
+func groupGrantable(grantable map[string]map[string][]grantableRole) []grantableKLPD {
+	klpds := make([]grantableKLPD, 0, len(grantable))
+	for klpd, units := range grantable {
+		group := grantableKLPD{Code: klpd, SatuanKerja: make([]grantableSatuanKerja, 0, len(units))}
+		for satker, roles := range units {
+			group.SatuanKerja = append(group.SatuanKerja, grantableSatuanKerja{Code: satker, Roles: roles})
+		}
+		sort.Slice(group.SatuanKerja, func(i, j int) bool {
+			return group.SatuanKerja[i].Code < group.SatuanKerja[j].Code
+		})
+		klpds = append(klpds, group)
+	}
+	sort.Slice(klpds, func(i, j int) bool {
+		return klpds[i].Code < klpds[j].Code
+	})
+	return klpds
+}
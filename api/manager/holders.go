@@ -0,0 +1,107 @@
+package manager
+
+import (
+	"net/http"
+
+	"spse-role-poc/api/policy"
+)
+
+type roleHolders struct {
+	Role   Role     `json:"role"`
+	Grants []string `json:"grants,omitempty"` // the roles asked about this role may grant
+	Users  []User   `json:"users"`
+}
+
+// Handler for Role Holders
+// Requires either the query parameter `role`, e.g. "A:A1:PPK", or `satuan_kerja`, e.g. "A:A1"
+// Responds with the users holding the role (or any role of the satuan kerja) as `holders`,
+// and the users holding a role which may grant it under the delegation rules as `granters`
+func (s *Service) RoleHoldersHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	catalog, err := s.Catalog.Roles()
+	if err != nil {
+		writeDirectoryError(w, err)
+		return
+	}
+
+	// the catalog roles asked about
+	var targets []Role
+	switch {
+	case query.Get("role") != "" && query.Get("satuan_kerja") == "":
+		name, v := s.Policy.ParseRole(query.Get("role"))
+		if v != nil {
+			writeViolations(w, []*policy.Violation{v})
+			return
+		}
+		targets, err = s.Catalog.Lookup([]string{name.String()})
+		if err != nil {
+			writeDirectoryError(w, err)
+			return
+		}
+	case query.Get("satuan_kerja") != "" && query.Get("role") == "":
+		scope, err := policy.ParseScope(query.Get("satuan_kerja"))
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		for _, role := range catalog {
+			if name, v := s.Policy.ParseRole(role.Name); v == nil && name.Scope() == scope.Scope() {
+				targets = append(targets, role)
+			}
+		}
+	default:
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "Either role or satuan_kerja is required")
+		return
+	}
+
+	// a catalog role is a granter if it may grant any of the targets on its own
+	granters := make([]roleHolders, 0)
+	for _, role := range catalog {
+		granter := roleHolders{Role: role}
+		for _, target := range targets {
+			if s.Policy.CanGrant([]string{role.Name}, target.Name) == nil {
+				granter.Grants = append(granter.Grants, target.Name)
+			}
+		}
+		if len(granter.Grants) > 0 {
+			granters = append(granters, granter)
+		}
+	}
+
+	// users of each role, fetched once per role
+	users := make(map[string][]User)
+	roleUsers := func(role Role) ([]User, error) {
+		if list, ok := users[role.ID]; ok {
+			return list, nil
+		}
+		list, err := s.Dir.RoleUsers(role.ID)
+		if err != nil {
+			return nil, err
+		}
+		users[role.ID] = list
+		return list, nil
+	}
+
+	holders := make([]roleHolders, 0, len(targets))
+	for _, role := range targets {
+		list, err := roleUsers(role)
+		if err != nil {
+			writeDirectoryError(w, err)
+			return
+		}
+		holders = append(holders, roleHolders{Role: role, Users: list})
+	}
+	for i := range granters {
+		if granters[i].Users, err = roleUsers(granters[i].Role); err != nil {
+			writeDirectoryError(w, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"role":         query.Get("role"),
+		"satuan_kerja": query.Get("satuan_kerja"),
+		"holders":      holders,
+		"granters":     granters,
+	})
+}
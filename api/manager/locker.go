@@ -0,0 +1,62 @@
+package manager
+
+import (
+	"context"
+	"sync"
+)
+
+// Locker serializes the role mutations of a user, so that the roles a handler validates
+// are still the user's roles when it writes them.
+// MemoryLocker is enough for a single instance of the API; instances sharing a tenant need
+// a Locker backed by shared storage (e.g. a Redis or database lock) keyed by the user id.
+type Locker interface {
+	// Lock blocks until the lock of `uid` is held or ctx is done.
+	// The returned function releases the lock.
+	Lock(ctx context.Context, uid string) (unlock func(), err error)
+}
+
+// MemoryLocker is an in-process Locker
+type MemoryLocker struct {
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+type userLock struct {
+	held    chan struct{} // holds a value while locked
+	waiters int           // number of holders and waiters, the lock is dropped at 0
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{locks: make(map[string]*userLock)}
+}
+
+func (l *MemoryLocker) Lock(ctx context.Context, uid string) (func(), error) {
+	l.mu.Lock()
+	lock, ok := l.locks[uid]
+	if !ok {
+		lock = &userLock{held: make(chan struct{}, 1)}
+		l.locks[uid] = lock
+	}
+	lock.waiters++
+	l.mu.Unlock()
+
+	select {
+	case lock.held <- struct{}{}:
+		return func() {
+			<-lock.held
+			l.release(uid, lock)
+		}, nil
+	case <-ctx.Done():
+		l.release(uid, lock)
+		return nil, ctx.Err()
+	}
+}
+
+func (l *MemoryLocker) release(uid string, lock *userLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock.waiters--
+	if lock.waiters == 0 {
+		delete(l.locks, uid)
+	}
+}
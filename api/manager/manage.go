@@ -4,15 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"sort"
-	"strings"
 
-	"github.com/auth0/go-auth0"
-	"github.com/auth0/go-auth0/management"
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/policy"
 )
 
 // User Information
-// A role must follows the following format: "{satuan_kerja}:{role_function}", e.g. "A1:PP", "A2:Admin PPE"
+// A role must follows the format of policy.RoleName: "{KLPD}:{satuan_kerja}:{role_function}", e.g. "A:A1:PP", "B:A2:Admin PPE"
 type userInfo struct {
 	ID       string   `json:"id"`
 	Email    string   `json:"email"`
@@ -20,329 +18,324 @@ type userInfo struct {
 	Roles    []string `json:"roles"`
 }
 
-// struct to store a list of error message
-type error_message struct {
-	Errors []string `"json:errors"`
+// Response of a successful role update
+type rolesResponse struct {
+	Message string   `json:"message"`
+	Roles   []string `json:"roles"`   // roles held by the user after the update
+	Added   []string `json:"added"`   // roles assigned by the update
+	Removed []string `json:"removed"` // roles removed by the update
+	DryRun  bool     `json:"dry_run,omitempty"`
 }
 
 // Handler for New User Creation
 // Requires `email` and `password` input from the request body
 // Will create a new user with `roles` if the field is filled.
-func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+// The assigner must be allowed to grant every role.
+// With `?dry_run=true` or `X-Dry-Run: true`, responds with the roles the user would get without creating it
+func (s *Service) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 	var userinfo userInfo
 	err := json.NewDecoder(r.Body).Decode(&userinfo)
 
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
 		return
 	}
 	if userinfo.Email == "" {
-		http.Error(w, "Email cannot be empty", http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "Email cannot be empty")
 		return
 	}
 	if userinfo.Password == "" {
-		http.Error(w, "Password cannot be empty", http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "Password cannot be empty")
 		return
 	}
+	event := &audit.Event{Action: audit.ActionCreateUser, Email: userinfo.Email, After: userinfo.Roles}
+	var errList []*policy.Violation
 
-	// setup user information
-	newUser := &management.User{
-		Connection: auth0.String("Username-Password-Authentication"),
-		Email:      auth0.String(userinfo.Email),
-		Password:   auth0.String(userinfo.Password),
+	userinfo.Roles, errList = s.normalizeRoles(userinfo.Roles)
+	if errList != nil {
+		s.deny(w, r, event, errList)
+		return
 	}
-
-	errList := ValidateRoles(userinfo.Roles)
+	event.After = userinfo.Roles
+	if errList = s.authorize(r, event, "", userinfo.Roles, nil); errList != nil {
+		s.forbid(w, r, event, errList)
+		return
+	}
+	errList = s.Policy.ValidateRoles(userinfo.Roles)
 	if errList != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-
-		// parse messages into json
-		var errListStr []string
-		for _, err := range errList {
-			errListStr = append(errListStr, err.Error())
-		}
+		s.deny(w, r, event, errList)
+		return
+	}
 
-		json.NewEncoder(w).Encode(error_message{
-			Errors: errListStr,
-		})
+	roles, err := s.RetrieveRoleByNames(userinfo.Roles)
+	if err != nil {
+		s.fail(w, r, event, err)
+		return
+	}
+	if isDryRun(r) {
+		writeDryRun(w, roles, roles, nil)
 		return
 	}
 
 	// Create a new user
-	err = Auth0API.User.Create(newUser)
+	uid, err := s.Dir.CreateUser(userinfo.Email, userinfo.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.fail(w, r, event, err)
 		return
 	}
+	event.Target = uid
 
-	if userinfo.Roles != nil && len(userinfo.Roles) > 0 {
-		err = assignRolesHelper(*newUser.ID, userinfo.Roles)
+	if len(roles) > 0 {
+		err = s.Dir.AssignRoles(uid, roles)
 		if err != nil {
-			Auth0API.User.Delete(*newUser.ID)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			s.Dir.DeleteUser(uid)
+			s.fail(w, r, event, err)
 			return
 		}
 	}
+	event.Decision = audit.DecisionAllow
+	s.record(r, event)
 
+	w.Header().Set("ETag", roleSetVersion(roles))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(fmt.Sprintf(`{"message":"New user successfully creaded with ID: %s"}`, *newUser.ID)))
+	w.Write([]byte(fmt.Sprintf(`{"message":"New user successfully creaded with ID: %s"}`, uid)))
 }
 
 // Handler for Rewrite Roles
 // Requires `id` of user and `roles` as part of request body
 // will update the roles of user if `roles` is a valid configuration, or do nothing otherwise
-func RewriteRolesHandler(w http.ResponseWriter, r *http.Request) {
+// The assigner must be allowed to grant every added role and to remove every removed role
+// With an If-Match header, the update is refused with 412 unless it matches the version (ETag) of the user's roles
+// Only the roles which differ are removed and assigned; if that fails halfway the previous roles are restored
+// Roles outside of the policy's naming scheme are not managed here, the user keeps them
+// With `?dry_run=true` or `X-Dry-Run: true`, responds with the roles the user would hold without changing them
+func (s *Service) RewriteRolesHandler(w http.ResponseWriter, r *http.Request) {
 	var userinfo userInfo
 	err := json.NewDecoder(r.Body).Decode(&userinfo)
 
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
 		return
 	}
 	if userinfo.ID == "" {
-		http.Error(w, "user id cannot be empty", http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "user id cannot be empty")
 		return
 	}
+	event := &audit.Event{Action: audit.ActionRewriteRoles, Target: userinfo.ID, After: userinfo.Roles}
+	var errList []*policy.Violation
 
-	errList := ValidateRoles(userinfo.Roles)
+	userinfo.Roles, errList = s.normalizeRoles(userinfo.Roles)
 	if errList != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
+		s.deny(w, r, event, errList)
+		return
+	}
+	event.After = userinfo.Roles
 
-		// parse messages into json
-		var errListStr []string
-		for _, err := range errList {
-			errListStr = append(errListStr, err.Error())
-		}
+	roles, err := s.RetrieveRoleByNames(userinfo.Roles)
+	if err != nil {
+		s.fail(w, r, event, err)
+		return
+	}
 
-		json.NewEncoder(w).Encode(error_message{
-			Errors: errListStr,
-		})
+	// Hold the user's lock until the roles are written, so that concurrent requests
+	// for the same user are validated against each other's result
+	unlock, err := s.Locker.Lock(r.Context(), userinfo.ID)
+	if err != nil {
+		WriteError(w, http.StatusServiceUnavailable, CodeDirectoryError, "Could not lock user: "+err.Error())
 		return
 	}
+	defer unlock()
 
-	// Remove all old roles
-	old_roles, err := Auth0API.User.Roles(userinfo.ID)
+	old_roles, err := s.Dir.UserRoles(userinfo.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDirectoryError(w, err)
 		return
 	}
-	if old_roles.Roles != nil && len(old_roles.Roles) > 0 {
-		err = Auth0API.User.RemoveRoles(userinfo.ID, old_roles.Roles)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if !checkVersion(w, r, old_roles) {
+		return
 	}
+	event.Before = roleNames(old_roles)
 
-	if userinfo.Roles != nil && len(userinfo.Roles) > 0 {
-		err = assignRolesHelper(userinfo.ID, userinfo.Roles)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	// Only the difference to the current roles is authorized and applied
+	managed, unmanaged := s.splitManaged(old_roles)
+	add, remove := diffRoles(managed, roles)
+	if errList = s.authorize(r, event, userinfo.ID, roleNames(add), roleNames(remove)); errList != nil {
+		s.forbid(w, r, event, errList)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"message": "Roles successfully updated"}`))
+	errList = s.Policy.ValidateRoles(userinfo.Roles)
+	if errList != nil {
+		s.deny(w, r, event, errList)
+		return
+	}
+	if isDryRun(r) {
+		writeDryRun(w, append(roles, unmanaged...), add, remove)
+		return
+	}
+	err = s.applyDelta(userinfo.ID, add, remove)
+	if err != nil {
+		s.fail(w, r, event, err)
+		return
+	}
+	event.Decision = audit.DecisionAllow
+
+	// Respond with the roles the user holds now, as confirmed by the directory
+	new_roles, err := s.Dir.UserRoles(userinfo.ID)
+	if err != nil {
+		s.record(r, event)
+		writeDirectoryError(w, err)
+		return
+	}
+	event.After = roleNames(new_roles)
+	s.record(r, event)
+
+	w.Header().Set("ETag", roleSetVersion(new_roles))
+	writeJSON(w, http.StatusOK, rolesResponse{
+		Message: "Roles successfully updated",
+		Roles:   roleNames(new_roles),
+		Added:   roleNames(add),
+		Removed: roleNames(remove),
+	})
 }
 
-// Handler for Rewrite Roles
+// Handler for Add Roles
 // Requires `id` of user and `roles` as part of request body
-// will update the roles of user if `roles` is a valid configuration, or do nothing otherwise
-func AddRolesHandler(w http.ResponseWriter, r *http.Request) {
+// will add `roles` to the user if the roles combined with the user's roles are a valid configuration, or do nothing otherwise
+// The assigner must be allowed to grant every role the user does not hold yet
+// With an If-Match header, the update is refused with 412 unless it matches the version (ETag) of the user's roles
+// With `?dry_run=true` or `X-Dry-Run: true`, responds with the roles the user would hold without changing them
+func (s *Service) AddRolesHandler(w http.ResponseWriter, r *http.Request) {
 	var userinfo userInfo
 	err := json.NewDecoder(r.Body).Decode(&userinfo)
 
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
 		return
 	}
 	if userinfo.ID == "" {
-		http.Error(w, "user id cannot be empty", http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "user id cannot be empty")
 		return
 	}
 	if userinfo.Roles == nil || len(userinfo.Roles) == 0 {
-		http.Error(w, "To be added roles cannot be empty", http.StatusBadRequest)
-		return
-	}
-	sort.Strings(userinfo.Roles)
-
-	// get old roles for the current user, and check if the roles combined
-	// with the future roles will trigger an error
-	// Only add old roles that has at least one common "satuan_kerja" as userinfo.Roles
-	// Note: old_roles is sorted by role's Name
-	old_roles, err := Auth0API.User.Roles(userinfo.ID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "To be added roles cannot be empty")
 		return
 	}
-
-	left_bound := 0
-	for i, role := range userinfo.Roles {
-		idx := strings.Index(role, ":")
-		if idx == -1 {
-			continue
-		}
-		klpd := role[:idx]
-		if i > 0 && strings.HasPrefix(userinfo.Roles[i-1], klpd+":") {
-			// the role is already added in the previous iteration
-			continue
-		} else {
-			left, right := left_bound, len(old_roles.Roles)-1
-			for left < right {
-				mid := (left + right) >> 1
-				if *old_roles.Roles[mid].Name < klpd+":" {
-					left = mid + 1
-				} else {
-					right = mid
-				}
-			}
-			for ; left < len(old_roles.Roles) && strings.HasPrefix(*old_roles.Roles[left].Name, klpd+":"); left++ {
-				userinfo.Roles = append(userinfo.Roles, *old_roles.Roles[left].Name)
-			}
-			// Since both old_roles and userinfo are sorted, future iterations on userinfo
-			// must be in at the greater index.
-			left_bound = left
-		}
-	}
-
-	errList := ValidateRoles(userinfo.Roles)
+	event := &audit.Event{Action: audit.ActionAddRoles, Target: userinfo.ID, After: userinfo.Roles}
+	var errList []*policy.Violation
+	userinfo.Roles, errList = s.normalizeRoles(userinfo.Roles)
 	if errList != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-
-		// parse messages into json
-		var errListStr []string
-		for _, err := range errList {
-			errListStr = append(errListStr, err.Error())
-		}
-
-		json.NewEncoder(w).Encode(error_message{
-			Errors: errListStr,
-		})
+		s.deny(w, r, event, errList)
 		return
 	}
+	event.After = userinfo.Roles
 
-	err = assignRolesHelper(userinfo.ID, userinfo.Roles)
+	roles, err := s.RetrieveRoleByNames(userinfo.Roles)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.fail(w, r, event, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"message": "Roles successfully updated"}`))
-}
-
-// A helper function to assign `rolenames` to user with user id `uid`
-//
-// Preconditions:
-// - all roles in rolenames are valid role
-// - a single user with all roles in rolenames does not violate the role rule.
-func assignRolesHelper(uid string, rolenames []string) error {
-	roles, err := RetrieveRoleByNames(rolenames)
+	// Hold the user's lock until the roles are written, so that concurrent requests
+	// for the same user are validated against each other's result
+	unlock, err := s.Locker.Lock(r.Context(), userinfo.ID)
 	if err != nil {
-		return err
+		WriteError(w, http.StatusServiceUnavailable, CodeDirectoryError, "Could not lock user: "+err.Error())
+		return
 	}
+	defer unlock()
 
-	err = Auth0API.User.AssignRoles(uid, roles)
+	// get old roles for the current user, and check if the roles combined
+	// with the future roles will trigger an error
+	// All old roles take part, since rules may be scoped to the whole user (policy.ScopeGlobal)
+	old_roles, err := s.Dir.UserRoles(userinfo.ID)
 	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func QueryAssignHandler(w http.ResponseWriter, r *http.Request) {
-	type queryVar struct {
-		AssignerUID string `json:"assigner_uid"`
-		CreateRole  string `json:"create_role"`
+		writeDirectoryError(w, err)
+		return
 	}
-	var query queryVar
-	err := json.NewDecoder(r.Body).Decode(&query)
-
-	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !checkVersion(w, r, old_roles) {
 		return
 	}
-	if query.CreateRole == "" {
-		http.Error(w, "Assignee UID cannot be empty", http.StatusBadRequest)
+	add, _ := diffRoles(old_roles, roles)
+	new_roles := append(append([]Role{}, old_roles...), add...)
+	event.Before = roleNames(old_roles)
+	event.After = roleNames(new_roles)
+	if errList = s.authorize(r, event, userinfo.ID, roleNames(add), nil); errList != nil {
+		s.forbid(w, r, event, errList)
 		return
 	}
 
-	idx := strings.Index(query.CreateRole, ":")
-	if idx == -1 {
-		http.Error(w, fmt.Sprintf("Role %s is not in correct format", query.CreateRole), http.StatusBadRequest)
-	}
+	combined := append(append([]string{}, userinfo.Roles...), s.managedRoles(old_roles)...)
 
-	satuanKerja, assigneeRole := query.CreateRole[:idx], query.CreateRole[idx+1:]
-	assignerRolelist, err := Auth0API.User.Roles(query.AssignerUID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	errList = s.Policy.ValidateRoles(combined)
+	if errList != nil {
+		s.deny(w, r, event, errList)
 		return
 	}
-
-	left, right := 0, len(assignerRolelist.Roles)-1
-	for left < right {
-		mid := (left + right) >> 1
-		if *assignerRolelist.Roles[mid].Name < satuanKerja+":" {
-			left = mid + 1
-		} else {
-			right = mid
-		}
+	if isDryRun(r) {
+		writeDryRun(w, new_roles, add, nil)
+		return
 	}
 
-	// only PPE and Agency has the power to create other users
-	// PPE can create all but PPE and Auditor
-	// Agency can create all but PPE, Auditor, Agency
-	assignerPPE, assignerAgency := false, false
-	for ; left < len(assignerRolelist.Roles) && strings.HasPrefix(*assignerRolelist.Roles[left].Name, satuanKerja+":"); left++ {
-		if *assignerRolelist.Roles[left].Name == satuanKerja+":"+"Admin PPE" {
-			assignerPPE = true
-		}
-		if *assignerRolelist.Roles[left].Name == satuanKerja+":"+"Admin Agency" {
-			assignerAgency = true
-		}
+	err = s.Dir.AssignRoles(userinfo.ID, roles)
+	if err != nil {
+		s.fail(w, r, event, err)
+		return
 	}
+	event.Decision = audit.DecisionAllow
+	s.record(r, event)
 
+	w.Header().Set("ETag", roleSetVersion(new_roles))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if assignerPPE {
-		if assigneeRole == "Admin PPE" || assigneeRole == "Auditor" {
-			w.Write([]byte(`{"message": "Action not allowed"}`))
-		} else {
-			w.Write([]byte(`{"message": "Action allowed"}`))
-		}
-	} else if assignerAgency {
-		if assigneeRole == "Admin PPE" || assigneeRole == "Auditor" || assigneeRole == "Admin Agency" {
-			w.Write([]byte(`{"message": "Action not allowed"}`))
-		} else {
-			w.Write([]byte(`{"message": "Action allowed"}`))
-		}
-	} else {
-		w.Write([]byte(`{"message": "Action not allowed"}`))
-	}
+	w.Write([]byte(`{"message": "Roles successfully updated"}`))
 }
 
 // Handler for deleting user based on userid
-func DeleteUser(w http.ResponseWriter, r *http.Request) {
+// Requires `id` of user as part of request body
+// The assigner must be allowed to remove every role the user holds, except those outside of the policy's naming scheme
+func (s *Service) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	var userinfo userInfo
 	err := json.NewDecoder(r.Body).Decode(&userinfo)
 
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if userinfo.ID == "" {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "user id cannot be empty")
+		return
+	}
+
+	unlock, err := s.Locker.Lock(r.Context(), userinfo.ID)
+	if err != nil {
+		WriteError(w, http.StatusServiceUnavailable, CodeDirectoryError, "Could not lock user: "+err.Error())
+		return
+	}
+	defer unlock()
+
+	// the roles are kept in the audit log, the directory forgets them with the user
+	old_roles, err := s.Dir.UserRoles(userinfo.ID)
+	if err != nil {
+		writeDirectoryError(w, err)
+		return
+	}
+	event := &audit.Event{Action: audit.ActionDeleteUser, Target: userinfo.ID, Before: roleNames(old_roles)}
+	if errList := s.authorize(r, event, userinfo.ID, nil, s.managedRoles(old_roles)); errList != nil {
+		s.forbid(w, r, event, errList)
 		return
 	}
 
-	err = Auth0API.User.Delete(userinfo.ID)
+	err = s.Dir.DeleteUser(userinfo.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.fail(w, r, event, err)
+		return
 	}
+	event.Decision = audit.DecisionAllow
+	s.record(r, event)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf(`{"message":"Successfully deleted user"`)))
+	w.Write([]byte(`{"message":"Successfully deleted user"}`))
 }
@@ -0,0 +1,204 @@
+package manager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemoryDirectory is an in-memory Directory, used to run the API and the tests
+// without an Auth0 tenant
+type MemoryDirectory struct {
+	mu    sync.Mutex
+	roles map[string]Role // roles maps each `role id` to its role
+	users map[string]*memoryUser
+}
+
+type memoryUser struct {
+	email    string
+	password string
+	roles    map[string]bool // set of `role id`
+}
+
+// Creates a MemoryDirectory whose role catalog consists of rolenames
+func NewMemoryDirectory(rolenames ...string) *MemoryDirectory {
+	d := &MemoryDirectory{
+		roles: make(map[string]Role),
+		users: make(map[string]*memoryUser),
+	}
+	for _, rolename := range rolenames {
+		id := "rol_" + randomHex(8)
+		d.roles[id] = Role{ID: id, Name: rolename, Description: "Placeholder Description"}
+	}
+	return d
+}
+
+func (d *MemoryDirectory) CreateUser(email, password string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, user := range d.users {
+		if user.email == email {
+			return "", fmt.Errorf("The user already exists.")
+		}
+	}
+
+	// mimic Auth0's user id format for database connections
+	uid := "auth0|" + randomHex(12)
+	d.users[uid] = &memoryUser{
+		email:    email,
+		password: password,
+		roles:    make(map[string]bool),
+	}
+	return uid, nil
+}
+
+func (d *MemoryDirectory) DeleteUser(uid string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.users, uid)
+	return nil
+}
+
+func (d *MemoryDirectory) UserRoles(uid string) ([]Role, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, ok := d.users[uid]
+	if !ok {
+		return nil, fmt.Errorf("The user does not exist.")
+	}
+
+	roles := make([]Role, 0, len(user.roles))
+	for id := range user.roles {
+		roles = append(roles, d.roles[id])
+	}
+	sortRoles(roles)
+	return roles, nil
+}
+
+func (d *MemoryDirectory) AssignRoles(uid string, roles []Role) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, ok := d.users[uid]
+	if !ok {
+		return fmt.Errorf("The user does not exist.")
+	}
+	for _, role := range roles {
+		if _, ok := d.roles[role.ID]; !ok {
+			return fmt.Errorf("Role %s does not exist.", role.ID)
+		}
+	}
+	for _, role := range roles {
+		user.roles[role.ID] = true
+	}
+	return nil
+}
+
+func (d *MemoryDirectory) RemoveRoles(uid string, roles []Role) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, ok := d.users[uid]
+	if !ok {
+		return fmt.Errorf("The user does not exist.")
+	}
+	for _, role := range roles {
+		delete(user.roles, role.ID)
+	}
+	return nil
+}
+
+func (d *MemoryDirectory) RoleUsers(id string) ([]User, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.roles[id]; !ok {
+		return nil, fmt.Errorf("The role does not exist.")
+	}
+	users := make([]User, 0)
+	for uid, user := range d.users {
+		if user.roles[id] {
+			users = append(users, User{ID: uid, Email: user.email})
+		}
+	}
+	sortUsers(users)
+	return users, nil
+}
+
+func (d *MemoryDirectory) ListRoles() ([]Role, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	roles := make([]Role, 0, len(d.roles))
+	for _, role := range d.roles {
+		roles = append(roles, role)
+	}
+	sortRoles(roles)
+	return roles, nil
+}
+
+func (d *MemoryDirectory) CreateRole(name, description string) (Role, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, role := range d.roles {
+		if role.Name == name {
+			return Role{}, fmt.Errorf("Role name already exists")
+		}
+	}
+	role := Role{ID: "rol_" + randomHex(8), Name: name, Description: description}
+	d.roles[role.ID] = role
+	return role, nil
+}
+
+func (d *MemoryDirectory) UpdateRoleDescription(id, description string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	role, ok := d.roles[id]
+	if !ok {
+		return fmt.Errorf("The role does not exist.")
+	}
+	role.Description = description
+	d.roles[id] = role
+	return nil
+}
+
+func (d *MemoryDirectory) DeleteRole(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.roles[id]; !ok {
+		return fmt.Errorf("The role does not exist.")
+	}
+	delete(d.roles, id)
+	for _, user := range d.users {
+		delete(user.roles, id)
+	}
+	return nil
+}
+
+func sortRoles(roles []Role) {
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+}
+
+func sortUsers(users []User) {
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -1,136 +1,128 @@
 package manager
 
 import (
+	"errors"
 	"fmt"
-	"sort"
-	"strings"
 
-	"github.com/auth0/go-auth0/management"
+	"spse-role-poc/api/policy"
 )
 
-type Pair struct {
-	First  string
-	Second string
-}
+// ErrRoleNotFound is returned when a role name is not in the role catalog
+var ErrRoleNotFound = errors.New("role not found")
 
-// A role has the format of `satuanKerja`:`	`
-//
-// # Hierarchy maps the division of each role
-//
-// Rule for role assignments
-// 1. A single user is not allowed to cross-function, i.e. has roles in different division
-// 2. For "Pelaku Pengadaan LPSE", a single user cannot be both "PPK" and "PP"
-// 3. A single user may have different function in different "satuan-kerja"
-var Hierarchy = map[string][]string{
-	"Pengelola LPSE":        {"Admin PPE", "Admin Agency", "Verifikator", "Helpdesk"},
-	"Pelaku Pengadaan LPSE": {"PPK", "KUPBJ", "Anggota Pokmil", "PP"},
-	"Auditor":               {"Auditor"},
+// Retrieve the list role objects for each rolename in rolenames, from the role catalog of s.Catalog
+// Returns an error wrapping ErrRoleNotFound if a rolename is not in the catalog
+func (s *Service) RetrieveRoleByNames(rolenames []string) ([]Role, error) {
+	return s.Catalog.Lookup(rolenames)
 }
 
-var division map[string]string // Division maps each `role name` to its division (parent)
-var RoleID map[string]string   // RoleID maps each `role name` to its `role id`
-
-// Generate the value of `Division“
-func RoleSetup() error {
-	division = make(map[string]string)
-	for div, roles := range Hierarchy {
-		for _, role := range roles {
-			division[role] = div
+// Parses every rolename with the policy and returns them in their normalized form,
+// without duplicates, or the violations of the rolenames which cannot be parsed
+func (s *Service) normalizeRoles(rolenames []string) ([]string, []*policy.Violation) {
+	normalized := make([]string, 0, len(rolenames))
+	seen := make(map[string]bool)
+	violations := make([]*policy.Violation, 0)
+	for _, rolename := range rolenames {
+		role, v := s.Policy.ParseRole(rolename)
+		if v != nil {
+			violations = append(violations, v)
+			continue
+		}
+		if !seen[role.String()] {
+			seen[role.String()] = true
+			normalized = append(normalized, role.String())
 		}
 	}
-	return nil
-}
 
-// Retrieve the list role objects for each rolename in rolenames and returns
-// Preconditions:
-// - each rolename in rolenames is a valid rolename and exists in Auth0's roles
-// Note:
-// - Auth0API.Role.List() Returns a list of roles sorted by role.Name
-func RetrieveRoleByNames(rolenames []string) ([]*management.Role, error) {
-	sort.Strings(rolenames)
+	if len(violations) != 0 {
+		return nil, violations
+	}
+	return normalized, nil
+}
 
-	// Note: List only returns by default 50 roles per page and maximum 100 per page
-	rolelist, err := Auth0API.Role.List(
-		management.PerPage(100),
-	)
-	if err != nil {
-		return nil, err
+// Returns the name of role in its normalized form, and whether the role follows the policy's
+// naming scheme. Roles outside of it are not managed here: they are kept on the user, and
+// neither checked against the role policy nor against the delegation rules.
+func (s *Service) managed(role Role) (string, bool) {
+	rolename, v := s.Policy.ParseRole(role.Name)
+	if v != nil {
+		return "", false
 	}
+	return rolename.String(), true
+}
 
-	left_bound := 0
-	roles := make([]*management.Role, 0)
-	for _, rolename := range rolenames {
-		left, right := left_bound, len(rolelist.Roles)-1
-		for left < right {
-			mid := (left + right) >> 1
-			if *rolelist.Roles[mid].Name < rolename {
-				left = mid + 1
-			} else {
-				right = mid
-			}
+// Returns the normalized names of the roles which are managed here (see managed)
+func (s *Service) managedRoles(roles []Role) []string {
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		if name, ok := s.managed(role); ok {
+			names = append(names, name)
 		}
-		roles = append(roles, rolelist.Roles[left])
-		left_bound = left
 	}
-	return roles, nil
+	return names
 }
 
-// Takes a list of rolenames which is to be assigned to a single user
-// and checks whether such combination of roles violates the ruless
-func ValidateRoles(rolenames []string) []error {
-	// no roles => no issue
-	if rolenames == nil || len(rolenames) == 0 {
-		return nil
+// Splits roles into the roles which are managed here and the others (see managed)
+func (s *Service) splitManaged(roles []Role) (managed, unmanaged []Role) {
+	for _, role := range roles {
+		if _, ok := s.managed(role); ok {
+			managed = append(managed, role)
+		} else {
+			unmanaged = append(unmanaged, role)
+		}
 	}
+	return managed, unmanaged
+}
 
-	errors := make([]error, 0)
-	rolenames_by_KLPD := make(map[string][]Pair)
-	for _, rolename := range rolenames {
-		parts := strings.Split(rolename, ":")
-		if len(parts) != 3 {
-			errors = append(errors, fmt.Errorf("Role %s is not in correct format", rolename))
-			continue
+// Returns the roles of `desired` which are not in `current`, and the roles of `current`
+// which are not in `desired`, compared by role.ID
+func diffRoles(current, desired []Role) (add, remove []Role) {
+	held := make(map[string]bool)
+	for _, role := range current {
+		held[role.ID] = true
+	}
+	wanted := make(map[string]bool)
+	for _, role := range desired {
+		wanted[role.ID] = true
+		if !held[role.ID] {
+			add = append(add, role)
 		}
-
-		KLPD, satuanKerja, roleFunction := parts[0], parts[1], parts[2]
-		rolenames_by_KLPD[KLPD] = append(rolenames_by_KLPD[KLPD], Pair{First: satuanKerja, Second: roleFunction})
 	}
-
-	if len(errors) != 0 {
-		return errors
+	for _, role := range current {
+		if !wanted[role.ID] {
+			remove = append(remove, role)
+		}
 	}
+	return add, remove
+}
 
-	for KLPD, rolenames := range rolenames_by_KLPD {
-		// division[role] must be the same for all role in roles
-		var div string = ""
-		role_PP, role_PPK := false, false
-
-		for _, rolename := range rolenames {
-			rolename_div, ok := division[rolename.Second]
-			if !ok {
-				errors = append(errors, fmt.Errorf("Role Function not found: %s", rolename.Second))
-			} else if div == "" {
-				div = rolename_div
-			} else if div != rolename_div {
-				errors = append(errors, fmt.Errorf("User's roles in %s may not cross-function different division: %s, %s", KLPD, div, rolename_div))
-			}
-
-			if rolename.Second == "PP" {
-				role_PP = true
-			} else if rolename.Second == "PPK" {
-				role_PPK = true
-			}
+// Removes `remove` from the user, then assigns `add`. Roles are removed first, so that the
+// user never holds both sets at once. If assigning fails, the removed roles are assigned
+// back; the returned error tells whether restoring them failed too.
+func (s *Service) applyDelta(uid string, add, remove []Role) error {
+	if len(remove) > 0 {
+		if err := s.Dir.RemoveRoles(uid, remove); err != nil {
+			return err
 		}
-
-		// special case: a user cannot have PP and PPK at the same time
-		if role_PP && role_PPK {
-			errors = append(errors, fmt.Errorf("User's roles in %s may not contain PP and PPK at the same time", KLPD))
+	}
+	if len(add) > 0 {
+		if err := s.Dir.AssignRoles(uid, add); err != nil {
+			if len(remove) > 0 {
+				if rerr := s.Dir.AssignRoles(uid, remove); rerr != nil {
+					return fmt.Errorf("%w; restoring the previous roles failed: %v", err, rerr)
+				}
+			}
+			return fmt.Errorf("%w; the previous roles were restored", err)
 		}
 	}
+	return nil
+}
 
-	if len(errors) != 0 {
-		return errors
+// Returns the names of roles
+func roleNames(roles []Role) []string {
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		names = append(names, role.Name)
 	}
-
-	return nil
+	return names
 }
@@ -1,24 +1,110 @@
 package manager
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strings"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/policy"
 
 	"github.com/auth0/go-auth0/management"
 )
 
-var Auth0API *management.Management
+// Service holds the dependencies shared by the handlers
+type Service struct {
+	Dir     Directory
+	Policy  *policy.Policy
+	Catalog *Catalog   // role name index of Dir
+	Locker  Locker     // serializes role mutations per user
+	Audit   audit.Sink // records every mutation, nil to disable
+
+	// approvals of changes of assigners' own roles, see ApprovalsHandler
+	Approvals ApprovalStore
+
+	// User ids of the operators, whose requests are not checked against the delegation rules
+	// nor the self-modification rule, e.g. to seed the first assigners, which no role may grant.
+	// Their mutations are recorded with Operator set in the audit log.
+	Operators []string
+}
+
+// Roles are looked up through dir if it is a *Catalog, otherwise through a
+// Catalog which downloads the role catalog on every lookup.
+// Role mutations are serialized with a MemoryLocker and approvals kept in a MemoryApprovalStore;
+// set Locker and Approvals to share them between instances
+func NewService(dir Directory, pol *policy.Policy) *Service {
+	catalog, ok := dir.(*Catalog)
+	if !ok {
+		catalog = NewCatalog(dir, 0)
+	}
+	return &Service{Dir: dir, Policy: pol, Catalog: catalog, Locker: NewMemoryLocker(), Approvals: NewMemoryApprovalStore()}
+}
+
+// ErrMissingScopes is returned by Connect if the client is not granted every scope in RequiredScopes
+var ErrMissingScopes = errors.New("client is missing Management API scopes")
+
+// Connects to the Auth0 Management API of AUTH0_DOMAIN and returns it as a Directory.
+// If MGMT_CLIENT_ID is set, tokens are requested with the client credentials grant of
+// MGMT_CLIENT_ID and MGMT_CLIENT_SECRET for MGMT_AUDIENCE (defaults to the Management API),
+// renewed before they expire, and the granted scopes are checked against RequiredScopes.
+// Otherwise the static MGMT_ACCESS_TOKEN is used.
+// `options` are applied after the defaults, e.g. management.WithInsecure() to
+// point the client at a fake tenant
+func Connect(options ...management.Option) (*Auth0Directory, error) {
+	domain := os.Getenv("AUTH0_DOMAIN")
+	defaults := []management.Option{management.WithStaticToken(os.Getenv("MGMT_ACCESS_TOKEN"))}
+
+	var creds *clientCredentials
+	if clientID := os.Getenv("MGMT_CLIENT_ID"); clientID != "" {
+		issuer := Issuer()
+		audience := os.Getenv("MGMT_AUDIENCE")
+		if audience == "" {
+			audience = issuer + "/api/v2/"
+		}
+		creds = newClientCredentials(issuer, clientID, os.Getenv("MGMT_CLIENT_SECRET"), audience)
 
-func ConnectAPI() {
-	auth0API, err := management.New(
-		os.Getenv("AUTH0_DOMAIN"),
-		management.WithStaticToken(os.Getenv("MGMT_ACCESS_TOKEN")),
+		// go-auth0 sets the header of its static token first, creds overwrites it
+		defaults = []management.Option{
+			management.WithStaticToken(""),
+			management.WithClient(&http.Client{Transport: creds}),
+		}
+	}
+
+	auth0API, err := management.New(domain, append(defaults, options...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	if creds != nil {
+		missing, err := creds.MissingScopes()
+		if err != nil {
+			return nil, fmt.Errorf("requesting Management API token: %w", err)
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("%w: %s", ErrMissingScopes, strings.Join(missing, ", "))
+		}
+	}
+	return NewAuth0Directory(auth0API), nil
+}
+
+// Issuer returns the base URL of the tenant AUTH0_DOMAIN, without a trailing slash.
+// AUTH0_DOMAIN may carry a scheme, e.g. http:// for a local fake tenant
+func Issuer() string {
+	issuer := strings.TrimSuffix(os.Getenv("AUTH0_DOMAIN"), "/")
+	if !strings.Contains(issuer, "://") {
+		issuer = "https://" + issuer
+	}
+	return issuer
+}
 
-		// TODO: Connect using CLIENT_ID and CLIENT_SECRET
-		// management.WithClientCredentials(os.Getenv("AUTH0_CLIENT_ID"), os.Getenv("AUTH0_CLIENT_SECRET")),
-	)
+// Same as Connect, but exits if the connection or the scope check fails
+func ConnectAPI(options ...management.Option) *Auth0Directory {
+	dir, err := Connect(options...)
 	if err != nil {
-		log.Fatal("Error connecting to Auth0 Management API:", err)
+		log.Fatal("Error connecting to Auth0 Management API: ", err)
 	}
-	Auth0API = auth0API
+	return dir
 }
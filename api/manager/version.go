@@ -0,0 +1,84 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// Returns the version of a user's role set as a strong ETag: a hash of the sorted role ids.
+// The version does not depend on the order of roles, and changes with any role added or removed.
+func roleSetVersion(roles []Role) string {
+	ids := make([]string, 0, len(roles))
+	for _, role := range roles {
+		ids = append(ids, role.ID)
+	}
+	sort.Strings(ids)
+
+	sum := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Returns true if the If-Match header of r is absent or matches `version`.
+// If-Match may list several versions separated by commas, or be "*" to match any version.
+func matchesVersion(r *http.Request, version string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes 412 Precondition Failed if the If-Match header of r does not match `current`
+// and returns false, so that a caller editing an outdated role set does not overwrite
+// changes it has not seen
+func checkVersion(w http.ResponseWriter, r *http.Request, current []Role) bool {
+	version := roleSetVersion(current)
+	if matchesVersion(r, version) {
+		return true
+	}
+	w.Header().Set("ETag", version)
+	WriteError(w, http.StatusPreconditionFailed, CodeVersionMismatch, "The user's roles were changed since version "+r.Header.Get("If-Match"))
+	return false
+}
+
+// Handler for User Roles
+// Requires the user id as URL parameter `id`
+// Responds with the user's roles, and their version in the ETag header to be sent
+// as If-Match by /addroles and /rewriteroles
+func (s *Service) UserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	// user ids such as "auth0|123" may arrive path-escaped
+	uid, err := url.PathUnescape(chi.URLParam(r, "id"))
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid user id")
+		return
+	}
+	roles, err := s.Dir.UserRoles(uid)
+	if err != nil {
+		writeDirectoryError(w, err)
+		return
+	}
+
+	version := roleSetVersion(roles)
+	w.Header().Set("ETag", version)
+	if match := r.Header.Get("If-None-Match"); match != "" && match == version {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":      uid,
+		"roles":   roleNames(roles),
+		"version": version,
+	})
+}
@@ -2,6 +2,8 @@ package middleware
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -9,14 +11,40 @@ import (
 	"strings"
 	"time"
 
+	"spse-role-poc/api/manager"
+
 	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
 	"github.com/auth0/go-jwt-middleware/v2/jwks"
 	"github.com/auth0/go-jwt-middleware/v2/validator"
 )
 
 // CustomClaims contains custom data we want from the token.
+// Roles is read from the namespaced claim AUTH0_ROLES_CLAIM, e.g. "https://example.com/roles",
+// which an Auth0 Action adds to the access token. Roles is nil if the token carries no such claim.
 type CustomClaims struct {
-	Scope string `json:"scope"`
+	Scope string   `json:"scope"`
+	Roles []string `json:"-"`
+
+	rolesClaim string
+}
+
+func (c *CustomClaims) UnmarshalJSON(data []byte) error {
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+	if raw, ok := claims["scope"]; ok {
+		if err := json.Unmarshal(raw, &c.Scope); err != nil {
+			return fmt.Errorf("scope claim: %w", err)
+		}
+	}
+	if raw, ok := claims[c.rolesClaim]; ok && c.rolesClaim != "" {
+		c.Roles = make([]string, 0)
+		if err := json.Unmarshal(raw, &c.Roles); err != nil {
+			return fmt.Errorf("%s claim: %w", c.rolesClaim, err)
+		}
+	}
+	return nil
 }
 
 // Validate does nothing for this example, but we need
@@ -25,14 +53,15 @@ func (c CustomClaims) Validate(ctx context.Context) error {
 	return nil
 }
 
-// EnsureValidToken is a middleware that will check the validity of our JWT.
-func EnsureValidToken() func(next http.Handler) http.Handler {
-	issuerURL, err := url.Parse("https://" + os.Getenv("AUTH0_DOMAIN") + "/")
+// Creates the validator of the access tokens of AUTH0_DOMAIN for AUTH0_AUDIENCE
+func newValidator() *validator.Validator {
+	issuerURL, err := url.Parse(manager.Issuer() + "/")
 	if err != nil {
 		log.Fatalf("Failed to parse the issuer url: %v", err)
 	}
 
 	provider := jwks.NewCachingProvider(issuerURL, 5*time.Minute)
+	rolesClaim := os.Getenv("AUTH0_ROLES_CLAIM")
 
 	jwtValidator, err := validator.New(
 		provider.KeyFunc,
@@ -41,7 +70,7 @@ func EnsureValidToken() func(next http.Handler) http.Handler {
 		[]string{os.Getenv("AUTH0_AUDIENCE")},
 		validator.WithCustomClaims(
 			func() validator.CustomClaims {
-				return &CustomClaims{}
+				return &CustomClaims{rolesClaim: rolesClaim}
 			},
 		),
 		validator.WithAllowedClockSkew(time.Minute),
@@ -49,13 +78,16 @@ func EnsureValidToken() func(next http.Handler) http.Handler {
 	if err != nil {
 		log.Fatalf("Failed to set up the jwt validator")
 	}
+	return jwtValidator
+}
+
+// EnsureValidToken is a middleware that will check the validity of our JWT.
+func EnsureValidToken() func(next http.Handler) http.Handler {
+	jwtValidator := newValidator()
 
 	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
 		log.Printf("Encountered error while validating JWT: %v", err)
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(`{"message":"Failed to validate JWT."}`))
+		manager.WriteError(w, http.StatusUnauthorized, manager.CodeUnauthorized, "Failed to validate JWT.")
 	}
 
 	middleware := jwtmiddleware.New(
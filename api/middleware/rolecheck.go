@@ -1,118 +1,104 @@
 package middleware
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
-	"strings"
+	"sync"
+	"time"
 
 	"spse-role-poc/api/manager"
-)
-
-// A middleware to validate whether the assigner is allowed to perform such action
-func ValidateRoles(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Read the original request body
-		buf, _ := ioutil.ReadAll(r.Body)
-		rdr1 := ioutil.NopCloser(bytes.NewBuffer(buf))
-		rdr2 := ioutil.NopCloser(bytes.NewBuffer(buf))
 
-		// data type to extract token and roles from the request body
-		type token_and_roles struct {
-			Token string   `json:"token"`
-			Roles []string `json:"roles"`
-		}
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
 
-		var data token_and_roles
-		err := json.NewDecoder(rdr1).Decode(&data)
+// A middleware resolving the roles of the assigner, which the handlers authorize the request against
+// Must run after EnsureValidToken: the assigner is the subject of the validated token.
+// The assigner's roles are read from the roles claim of the token, or looked up in `dir`
+// if the token carries none, and passed on to the handler, which checks every role the
+// request grants or removes against them with the delegation rules of the role policy.
+// The roles are cached per token until the token expires.
+func ValidateRoles(dir manager.Directory) func(next http.Handler) http.Handler {
+	cache := &assignerCache{entries: make(map[string]cachedAssigner)}
+	return func(next http.Handler) http.Handler {
+		return validateRoles(dir, cache, next)
+	}
+}
 
-		if err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+func validateRoles(dir manager.Directory, cache *assignerCache, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+		if !ok || claims.RegisteredClaims.Subject == "" {
+			manager.WriteError(w, http.StatusUnauthorized, manager.CodeUnauthorized, "Missing validated token")
 			return
 		}
+		token, _ := jwtmiddleware.AuthHeaderTokenExtractor(r)
 
-		req, err := http.NewRequest("GET", "https://"+os.Getenv("AUTH0_DOMAIN")+"/userinfo", nil)
-		req.Header.Set("Authorization", "Bearer "+data.Token)
-		res, err := http.DefaultClient.Do(req)
+		assignerRoles, err := cache.resolve(dir, token, claims)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			manager.WriteError(w, http.StatusInternalServerError, manager.CodeDirectoryError, err.Error())
 			return
 		}
-		defer res.Body.Close()
+		// the handlers check the roles granted and removed by the request against the assigner's
+		next.ServeHTTP(w, r.WithContext(manager.WithAssignerRoles(r.Context(), assignerRoles)))
+	})
+}
 
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+// Roles of the assigner of each token, kept until the token expires
+type assignerCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedAssigner
+}
 
-		// Retrieve only the sub(assigner uid) key from the response body
-		type jsonResponse struct {
-			Sub string `json:"sub"`
-		}
-		var response jsonResponse
-		err = json.Unmarshal(body, &response)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		assigner_uid := response.Sub
+type cachedAssigner struct {
+	roles  []string
+	expiry time.Time
+}
 
-		assignerRoleList, err := manager.Auth0API.User.Roles(assigner_uid)
+// Returns the roles of the subject of the validated token: the roles claim of the token if it
+// carries one, otherwise the subject's roles in `dir`. The result is cached until the token expires.
+func (c *assignerCache) resolve(dir manager.Directory, token string, claims *validator.ValidatedClaims) ([]string, error) {
+	if roles, ok := c.get(token); ok {
+		return roles, nil
+	}
+
+	var roles []string
+	if custom, _ := claims.CustomClaims.(*CustomClaims); custom != nil && custom.Roles != nil {
+		roles = custom.Roles
+	} else {
+		rolelist, err := dir.UserRoles(claims.RegisteredClaims.Subject)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, err
 		}
-
-		// assignerPPE[satuanKerja] is true IFF assigner has "Admin PPE" role in "satuanKerja"
-		assignerPPE := make(map[string]bool)
-
-		// assignerAgency[satuanKerja] is true IFF assigner has "Admin Agency" role in "satuanKerja"
-		assignerAgency := make(map[string]bool)
-
-		for _, role := range assignerRoleList.Roles {
-			idx := strings.LastIndex(*role.Name, ":")
-			if idx == -1 {
-				continue
-			}
-			satuanKerja := (*role.Name)[:idx]
-			roleFunction := (*role.Name)[idx+1:]
-
-			if roleFunction == "Admin PPE" {
-				assignerPPE[satuanKerja] = true
-			} else if roleFunction == "Admin Agency" {
-				assignerAgency[satuanKerja] = true
-			}
+		roles = make([]string, 0, len(rolelist))
+		for _, role := range rolelist {
+			roles = append(roles, role.Name)
 		}
+	}
+	c.put(token, roles, time.Unix(claims.RegisteredClaims.Expiry, 0))
+	return roles, nil
+}
 
-		for _, assignee_role := range data.Roles {
-			idx := strings.LastIndex(assignee_role, ":")
-			if idx == -1 {
-				http.Error(w, fmt.Sprintf("Role %s is not in correct format", assignee_role), http.StatusBadRequest)
-			}
-			satuanKerja := assignee_role[:idx]
-			roleFunction := assignee_role[idx+1:]
+func (c *assignerCache) get(token string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[token]
+	if !ok || !time.Now().Before(entry.expiry) {
+		return nil, false
+	}
+	return entry.roles, true
+}
 
-			if roleFunction == "Admin PPE" || roleFunction == "Auditor" {
-				http.Error(w, "Action not allowed", http.StatusForbidden)
-				return
-			} else if roleFunction == "Admin Agency" {
-				if !assignerPPE[satuanKerja] {
-					http.Error(w, "Action not allowed", http.StatusForbidden)
-					return
-				}
-			} else {
-				if !assignerPPE[satuanKerja] && !assignerAgency[satuanKerja] {
-					http.Error(w, "Action not allowed", http.StatusForbidden)
-					return
-				}
-			}
+// Stores the roles of token and drops the entries of expired tokens
+func (c *assignerCache) put(token string, roles []string, expiry time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for t, entry := range c.entries {
+		if !now.Before(entry.expiry) {
+			delete(c.entries, t)
 		}
-
-		// Copy back the original data to request body
-		r.Body = rdr2
-		next.ServeHTTP(w, r)
-	})
+	}
+	if token != "" && now.Before(expiry) {
+		c.entries[token] = cachedAssigner{roles: roles, expiry: expiry}
+	}
 }
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+
+	"spse-role-poc/api/manager"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// Scopes of the API, granted to the access tokens of its callers.
+// See the scope of each route in router.New
+const (
+	ScopeUsersRead   = "users:read"   // read the roles of users
+	ScopeUsersWrite  = "users:write"  // create users and change their roles
+	ScopeUsersDelete = "users:delete" // delete users
+	ScopeRolesRead   = "roles:read"   // read the role catalog, its holders and the decisions on it
+	ScopeAuditRead   = "audit:read"   // query the audit log
+	ScopeMetricsRead = "metrics:read" // read the runtime metrics of /debug/vars
+)
+
+// RequireScope is a middleware which only passes requests whose token is granted `scope`.
+// Must run after EnsureValidToken.
+func RequireScope(scope string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+			if !ok {
+				manager.WriteError(w, http.StatusUnauthorized, manager.CodeUnauthorized, "Missing validated token")
+				return
+			}
+			custom, ok := claims.CustomClaims.(*CustomClaims)
+			if !ok || !custom.HasScope(scope) {
+				manager.WriteError(w, http.StatusForbidden, manager.CodeForbidden, "Insufficient scope, requires "+scope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package policy
+
+import (
+	"fmt"
+)
+
+// CanGrant checks whether a user holding granterRoles may grant rolename.
+// Returns nil if the grant is allowed, or a violation describing why it is not.
+func (p *Policy) CanGrant(granterRoles []string, rolename string) *Violation {
+	target, v := p.ParseRole(rolename)
+	if v != nil {
+		return v
+	}
+	if p.delegates(granterRoles, target) {
+		return nil
+	}
+
+	return &Violation{
+		Code:        CodeGrantDenied,
+		KLPD:        target.KLPD,
+		SatuanKerja: target.SatuanKerja,
+		Roles:       []string{rolename},
+		Message:     fmt.Sprintf("Action not allowed: no role of the assigner may grant %s", target),
+	}
+}
+
+// CanRevoke checks whether a user holding granterRoles may remove rolename from a user.
+// A role may only be removed by those who may grant it.
+// Returns nil if the removal is allowed, or a violation describing why it is not.
+func (p *Policy) CanRevoke(granterRoles []string, rolename string) *Violation {
+	target, v := p.ParseRole(rolename)
+	if v != nil {
+		return v
+	}
+	if p.delegates(granterRoles, target) {
+		return nil
+	}
+
+	return &Violation{
+		Code:        CodeRevokeDenied,
+		KLPD:        target.KLPD,
+		SatuanKerja: target.SatuanKerja,
+		Roles:       []string{rolename},
+		Message:     fmt.Sprintf("Action not allowed: no role of the assigner may remove %s", target),
+	}
+}
+
+// Returns true if a delegation rule lets one of granterRoles grant target
+func (p *Policy) delegates(granterRoles []string, target RoleName) bool {
+	for _, granterRole := range granterRoles {
+		granter, v := p.ParseRole(granterRole)
+		if v != nil || granter.KLPD != target.KLPD {
+			continue
+		}
+
+		d, ok := p.delegation[granter.Function]
+		if !ok {
+			continue
+		}
+		// a KLPD-wide granter acts in every satuan kerja of its KLPD, a KLPD-wide
+		// target is only granted by KLPD-wide granters or with scope klpd
+		if d.Scope == ScopeSatuanKerja && !granter.Covers(target) {
+			continue
+		}
+		if contains(d.Grants, target.Function) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,316 @@
+// Package policy loads the role policy: the divisions each role function
+// belongs to and the rules a user's set of roles must satisfy.
+//
+// The policy is kept as data in a versioned YAML or JSON file (see policy.yaml)
+// so that procurement policy changes can be reviewed without a redeploy.
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Version of the policy file format understood by this package
+const Version = 1
+
+// Policy is the parsed content of a policy file
+//
+// Rule for role assignments
+// 1. Each role function belongs to exactly one division
+// 2. A user's roles must satisfy every rule, see Rule
+type Policy struct {
+	Version    int          `json:"version" yaml:"version"`
+	Divisions  []Division   `json:"divisions" yaml:"divisions"`
+	Rules      []Rule       `json:"rules" yaml:"rules"`
+	Delegation []Delegation `json:"delegation" yaml:"delegation"`
+	// How requests of assigners changing their own roles are handled, defaults to SelfModificationDeny
+	SelfModification string `json:"self_modification,omitempty" yaml:"self_modification,omitempty"`
+
+	division   map[string]string      // division maps each `role function` to its division (parent)
+	function   map[string]string      // function maps each lower-cased `role function` to its declared name
+	delegation map[string]*Delegation // delegation maps each granter `role function` to its delegation
+}
+
+// Handling of assigners changing their own roles
+const (
+	SelfModificationDeny     = "deny"     // refused
+	SelfModificationApproval = "approval" // requires a second user, the approver, to approve the exact change, which they may authorize as well
+	SelfModificationAllow    = "allow"    // authorized like any other change
+)
+
+// Division groups role functions, e.g. "Pelaku Pengadaan LPSE": {"PPK", "KUPBJ", "Anggota Pokmil", "PP"}
+type Division struct {
+	Name      string   `json:"name" yaml:"name"`
+	Functions []string `json:"functions" yaml:"functions"`
+}
+
+// Rule types
+const (
+	// At most one of the members may be held
+	Exclusive = "exclusive"
+	// At most Max of the members may be held
+	AtMost = "at_most"
+	// Holding any of Functions requires holding every function in Requires
+	Requires = "requires"
+)
+
+// Rule scopes, i.e. which of a user's roles are checked together
+const (
+	ScopeKLPD        = "klpd"         // roles within the same KLPD
+	ScopeSatuanKerja = "satuan_kerja" // roles within the same KLPD:satuanKerja
+	ScopeGlobal      = "global"       // all roles of the user
+)
+
+// Rule is a separation-of-duties rule evaluated on every group of roles in its Scope.
+// Members are either role functions or divisions; a division is held if any of its functions is held.
+//
+// Type defaults to Exclusive and Scope defaults to ScopeKLPD. If KLPD is set,
+// the rule only applies to roles in the listed KLPD.
+type Rule struct {
+	ID          string   `json:"id" yaml:"id"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty"`
+	Type        string   `json:"type,omitempty" yaml:"type,omitempty"`
+	Scope       string   `json:"scope,omitempty" yaml:"scope,omitempty"`
+	KLPD        []string `json:"klpd,omitempty" yaml:"klpd,omitempty"`
+	Functions   []string `json:"functions,omitempty" yaml:"functions,omitempty"`
+	Divisions   []string `json:"divisions,omitempty" yaml:"divisions,omitempty"`
+	Max         int      `json:"max,omitempty" yaml:"max,omitempty"`
+	Requires    []string `json:"requires,omitempty" yaml:"requires,omitempty"`
+}
+
+// Delegation lists the role functions a holder of the Granter function may grant.
+// Scope decides where the granter's role must be for the grant to apply:
+// ScopeSatuanKerja requires the same KLPD:satuanKerja as the granted role,
+// ScopeKLPD any satuanKerja of the same KLPD.
+type Delegation struct {
+	Granter string   `json:"granter" yaml:"granter"`
+	Scope   string   `json:"scope,omitempty" yaml:"scope,omitempty"`
+	Grants  []string `json:"grants" yaml:"grants"`
+}
+
+// Load reads and validates the policy file at path.
+// The format is chosen by the file extension: .yaml, .yml or .json
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+
+	p, err := Parse(data, strings.TrimPrefix(filepath.Ext(path), "."))
+	if err != nil {
+		return nil, fmt.Errorf("policy %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// Parse decodes and validates a policy in the given format ("yaml", "yml" or "json").
+// Unknown fields are rejected so that typos do not silently disable a rule.
+func Parse(data []byte, format string) (*Policy, error) {
+	var p Policy
+	switch format {
+	case "yaml", "yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&p); err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&p); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported policy format %q, expected yaml or json", format)
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate checks the policy for consistency and builds its lookup tables.
+// All problems found are returned together.
+func (p *Policy) Validate() error {
+	errs := make([]error, 0)
+	if p.Version != Version {
+		errs = append(errs, fmt.Errorf("version: unsupported policy version %d, expected %d", p.Version, Version))
+	}
+
+	p.division = make(map[string]string)
+	p.function = make(map[string]string)
+	divisions := make(map[string]bool)
+	if len(p.Divisions) == 0 {
+		errs = append(errs, fmt.Errorf("divisions: at least one division is required"))
+	}
+	for i, div := range p.Divisions {
+		if div.Name == "" {
+			errs = append(errs, fmt.Errorf("divisions[%d]: name cannot be empty", i))
+		} else if divisions[div.Name] {
+			errs = append(errs, fmt.Errorf("divisions[%d]: duplicate division %q", i, div.Name))
+		}
+		divisions[div.Name] = true
+
+		if len(div.Functions) == 0 {
+			errs = append(errs, fmt.Errorf("divisions[%d]: division %q has no functions", i, div.Name))
+		}
+		for j, function := range div.Functions {
+			if function == "" {
+				errs = append(errs, fmt.Errorf("divisions[%d].functions[%d]: function cannot be empty", i, j))
+			} else if normalizeSpace(function) != function {
+				errs = append(errs, fmt.Errorf("divisions[%d].functions[%d]: function %q has leading, trailing or repeated spaces", i, j, function))
+			} else if existing, ok := p.function[strings.ToLower(function)]; ok {
+				errs = append(errs, fmt.Errorf("divisions[%d].functions[%d]: function %q already belongs to division %q", i, j, function, p.division[existing]))
+			} else {
+				p.division[function] = div.Name
+				p.function[strings.ToLower(function)] = function
+			}
+		}
+	}
+
+	ruleIDs := make(map[string]bool)
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.ID == "" {
+			errs = append(errs, fmt.Errorf("rules[%d]: id cannot be empty", i))
+		} else if ruleIDs[rule.ID] {
+			errs = append(errs, fmt.Errorf("rules[%d]: duplicate rule id %q", i, rule.ID))
+		}
+		ruleIDs[rule.ID] = true
+
+		if rule.Type == "" {
+			rule.Type = Exclusive
+		}
+		if rule.Scope == "" {
+			rule.Scope = ScopeKLPD
+		}
+		errs = append(errs, p.validateRule(i, rule, divisions)...)
+	}
+
+	p.delegation = make(map[string]*Delegation)
+	for i := range p.Delegation {
+		d := &p.Delegation[i]
+		if d.Scope == "" {
+			d.Scope = ScopeSatuanKerja
+		}
+		if d.Scope != ScopeSatuanKerja && d.Scope != ScopeKLPD {
+			errs = append(errs, fmt.Errorf("delegation[%d]: unknown scope %q, expected %s or %s", i, d.Scope, ScopeSatuanKerja, ScopeKLPD))
+		}
+		if _, ok := p.division[d.Granter]; !ok {
+			errs = append(errs, fmt.Errorf("delegation[%d]: unknown granter function %q", i, d.Granter))
+		} else if _, ok := p.delegation[d.Granter]; ok {
+			errs = append(errs, fmt.Errorf("delegation[%d]: duplicate granter %q", i, d.Granter))
+		}
+		p.delegation[d.Granter] = d
+
+		if len(d.Grants) == 0 {
+			errs = append(errs, fmt.Errorf("delegation[%d]: granter %q grants no functions", i, d.Granter))
+		}
+		for j, function := range d.Grants {
+			if _, ok := p.division[function]; !ok {
+				errs = append(errs, fmt.Errorf("delegation[%d].grants[%d]: unknown function %q", i, j, function))
+			}
+		}
+	}
+
+	if p.SelfModification == "" {
+		p.SelfModification = SelfModificationDeny
+	}
+	switch p.SelfModification {
+	case SelfModificationDeny, SelfModificationApproval, SelfModificationAllow:
+	default:
+		errs = append(errs, fmt.Errorf("self_modification: unknown value %q, expected %s, %s or %s",
+			p.SelfModification, SelfModificationDeny, SelfModificationApproval, SelfModificationAllow))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Division returns the division of a role function
+func (p *Policy) Division(function string) (string, bool) {
+	div, ok := p.division[function]
+	return div, ok
+}
+
+// Granters returns the granter function of every delegation in the order they are declared.
+// Only these functions may be held KLPD-wide.
+func (p *Policy) Granters() []string {
+	granters := make([]string, 0, len(p.Delegation))
+	for _, d := range p.Delegation {
+		granters = append(granters, d.Granter)
+	}
+	return granters
+}
+
+// Functions returns every role function in the order they are declared
+func (p *Policy) Functions() []string {
+	functions := make([]string, 0, len(p.division))
+	for _, div := range p.Divisions {
+		functions = append(functions, div.Functions...)
+	}
+	return functions
+}
+
+func (p *Policy) validateRule(i int, rule *Rule, divisions map[string]bool) []error {
+	errs := make([]error, 0)
+	switch rule.Scope {
+	case ScopeKLPD, ScopeSatuanKerja, ScopeGlobal:
+	default:
+		errs = append(errs, fmt.Errorf("rules[%d]: rule %q has unknown scope %q, expected %s, %s or %s", i, rule.ID, rule.Scope, ScopeKLPD, ScopeSatuanKerja, ScopeGlobal))
+	}
+
+	members := len(rule.Functions) + len(rule.Divisions)
+	switch rule.Type {
+	case Exclusive, AtMost:
+		if (len(rule.Functions) == 0) == (len(rule.Divisions) == 0) {
+			errs = append(errs, fmt.Errorf("rules[%d]: rule %q must list either functions or divisions", i, rule.ID))
+		}
+		if len(rule.Requires) > 0 {
+			errs = append(errs, fmt.Errorf("rules[%d]: rule %q of type %s may not list requires", i, rule.ID, rule.Type))
+		}
+		if rule.Type == Exclusive {
+			if rule.Max != 0 {
+				errs = append(errs, fmt.Errorf("rules[%d]: rule %q of type %s may not set max", i, rule.ID, rule.Type))
+			}
+			if members < 2 {
+				errs = append(errs, fmt.Errorf("rules[%d]: rule %q must list at least two members", i, rule.ID))
+			}
+		} else if rule.Max < 1 || rule.Max >= members {
+			errs = append(errs, fmt.Errorf("rules[%d]: rule %q must set max between 1 and %d", i, rule.ID, members-1))
+		}
+	case Requires:
+		if len(rule.Functions) == 0 || len(rule.Requires) == 0 {
+			errs = append(errs, fmt.Errorf("rules[%d]: rule %q must list functions and the functions they require", i, rule.ID))
+		}
+		if len(rule.Divisions) > 0 || rule.Max != 0 {
+			errs = append(errs, fmt.Errorf("rules[%d]: rule %q of type %s may only list functions and requires", i, rule.ID, rule.Type))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("rules[%d]: rule %q has unknown type %q, expected %s, %s or %s", i, rule.ID, rule.Type, Exclusive, AtMost, Requires))
+	}
+
+	for j, function := range rule.Functions {
+		if _, ok := p.division[function]; !ok {
+			errs = append(errs, fmt.Errorf("rules[%d].functions[%d]: unknown function %q", i, j, function))
+		}
+	}
+	for j, function := range rule.Requires {
+		if _, ok := p.division[function]; !ok {
+			errs = append(errs, fmt.Errorf("rules[%d].requires[%d]: unknown function %q", i, j, function))
+		}
+	}
+	for j, div := range rule.Divisions {
+		if !divisions[div] {
+			errs = append(errs, fmt.Errorf("rules[%d].divisions[%d]: unknown division %q", i, j, div))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,261 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadDefaultPolicy(t *testing.T) {
+	p, err := Load("../../policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if div, _ := p.Division("PPK"); div != "Pelaku Pengadaan LPSE" {
+		t.Fatalf("unexpected division of PPK: %q", div)
+	}
+	if len(p.Functions()) != 9 {
+		t.Fatalf("expected 9 functions, got %v", p.Functions())
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	data := `{
+		"version": 1,
+		"divisions": [{"name": "Pelaku Pengadaan LPSE", "functions": ["PP", "PPK", "KUPBJ"]}],
+		"rules": [{"id": "SOD-PP-PPK", "functions": ["PP", "PPK"]}]
+	}`
+	p, err := Parse([]byte(data), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	violations := p.ValidateRoles([]string{"A:A1:PP", "A:A2:PPK", "A:A3:KUPBJ"})
+	if len(violations) != 1 {
+		t.Fatalf("expected a single violation, got %v", violations)
+	}
+	v := violations[0]
+	if v.Code != CodeExclusive || v.Rule != "SOD-PP-PPK" || v.KLPD != "A" || strings.Join(v.Roles, ",") != "A:A1:PP,A:A2:PPK" {
+		t.Fatalf("unexpected violation: %+v", v)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{
+			name:   "unsupported version",
+			policy: "version: 2\ndivisions: [{name: D, functions: [F]}]",
+			want:   "unsupported policy version 2",
+		},
+		{
+			name:   "unknown field",
+			policy: "version: 1\ndivision: []",
+			want:   "field division not found",
+		},
+		{
+			name:   "function in two divisions",
+			policy: "version: 1\ndivisions: [{name: D1, functions: [F]}, {name: D2, functions: [F]}]",
+			want:   `divisions[1].functions[0]: function "F" already belongs to division "D1"`,
+		},
+		{
+			name:   "rule with unknown function",
+			policy: "version: 1\ndivisions: [{name: D, functions: [F, G]}]\nrules: [{id: R, functions: [F, H]}]",
+			want:   `rules[0].functions[1]: unknown function "H"`,
+		},
+		{
+			name:   "rule with functions and divisions",
+			policy: "version: 1\ndivisions: [{name: D, functions: [F, G]}]\nrules: [{id: R, functions: [F, G], divisions: [D]}]",
+			want:   `rule "R" must list either functions or divisions`,
+		},
+		{
+			name:   "duplicate rule id",
+			policy: "version: 1\ndivisions: [{name: D, functions: [F, G]}]\nrules: [{id: R, functions: [F, G]}, {id: R, functions: [F, G]}]",
+			want:   `rules[1]: duplicate rule id "R"`,
+		},
+		{
+			name:   "unknown self modification",
+			policy: "version: 1\ndivisions: [{name: D, functions: [F]}]\nself_modification: ask",
+			want:   `self_modification: unknown value "ask"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.policy), "yaml")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	p, err := Parse([]byte(`
+version: 1
+divisions:
+  - name: Pengelola LPSE
+    functions: [Admin PPE, Admin Agency, Verifikator, Helpdesk]
+  - name: Pelaku Pengadaan LPSE
+    functions: [PPK, KUPBJ, Anggota Pokmil, PP]
+rules:
+  - id: R-EXCLUSIVE
+    functions: [PP, PPK]
+  - id: R-AT-MOST
+    type: at_most
+    scope: satuan_kerja
+    max: 2
+    functions: [Admin PPE, Admin Agency, Verifikator]
+  - id: R-REQUIRES
+    type: requires
+    scope: satuan_kerja
+    functions: [Admin Agency]
+    requires: [Helpdesk]
+  - id: R-GLOBAL
+    scope: global
+    klpd: [B]
+    divisions: [Pengelola LPSE, Pelaku Pengadaan LPSE]
+delegation:
+  - granter: Admin PPE
+    grants: [Admin Agency]
+  - granter: Admin Agency
+    grants: [Helpdesk]
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		roles []string
+		want  []string // rule ids of the expected violations
+	}{
+		{"exclusive across satuan kerja", []string{"A:A1:PP", "A:A2:PPK"}, []string{"R-EXCLUSIVE"}},
+		{"exclusive in different KLPD", []string{"A:A1:PP", "B:A1:PPK"}, nil},
+		{"at most", []string{"A:A1:Admin PPE", "A:A1:Verifikator", "A:A2:Admin PPE"}, nil},
+		{"at most exceeded", []string{"A:A1:Admin PPE", "A:A1:Verifikator", "A:A1:Admin Agency", "A:A1:Helpdesk"}, []string{"R-AT-MOST"}},
+		{"requires missing", []string{"A:A1:Admin Agency", "A:A2:Helpdesk"}, []string{"R-REQUIRES"}},
+		{"requires present", []string{"A:A1:Admin Agency", "A:A1:Helpdesk"}, nil},
+		{"global limited to KLPD B", []string{"A:A1:PP", "A:A1:Helpdesk"}, nil},
+		{"global", []string{"B:A1:PP", "B:A2:Helpdesk"}, []string{"R-GLOBAL"}},
+		{"KLPD-wide role held in the satuan kerja", []string{"A:*:Admin PPE", "A:A1:Verifikator", "A:A1:Admin Agency", "A:A1:Helpdesk"}, []string{"R-AT-MOST"}},
+		{"KLPD-wide role in another KLPD", []string{"B:*:Admin PPE", "A:A1:Verifikator", "A:A1:Admin Agency", "A:A1:Helpdesk"}, nil},
+		{"KLPD-wide role requires", []string{"A:*:Admin Agency", "A:A2:Helpdesk"}, nil},
+		{"KLPD-wide role alone", []string{"A:*:Admin Agency"}, []string{"R-REQUIRES"}},
+		{"KLPD-wide roles together", []string{"A:*:Admin PPE", "A:*:Admin Agency", "A:A2:Verifikator", "A:A2:Helpdesk"}, []string{"R-AT-MOST"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]string, 0)
+			for _, v := range p.ValidateRoles(tt.roles) {
+				if v.Rule == "" {
+					t.Fatalf("unexpected violation: %v", v)
+				}
+				got = append(got, v.Rule)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("expected violations %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCanGrant(t *testing.T) {
+	p, err := Load("../../policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		granter []string
+		role    string
+		allowed bool
+	}{
+		{"Admin PPE grants Admin Agency", []string{"A:A1:Admin PPE"}, "A:A1:Admin Agency", true},
+		{"Admin PPE may not grant Admin PPE", []string{"A:A1:Admin PPE"}, "A:A1:Admin PPE", false},
+		{"Admin PPE may not grant Auditor", []string{"A:A1:Admin PPE"}, "A:A1:Auditor", false},
+		{"Admin PPE only in its satuan kerja", []string{"A:A1:Admin PPE"}, "A:A2:PPK", false},
+		{"Admin PPE only in its KLPD", []string{"A:A1:Admin PPE"}, "B:A1:PPK", false},
+		{"Admin Agency grants PP", []string{"A:A1:Admin Agency"}, "A:A1:PP", true},
+		{"Admin Agency may not grant Admin Agency", []string{"A:A1:Admin Agency"}, "A:A1:Admin Agency", false},
+		{"any granter role suffices", []string{"A:A1:Helpdesk", "A:A2:Admin Agency"}, "A:A2:Helpdesk", true},
+		{"role without delegation", []string{"A:A1:Helpdesk"}, "A:A1:PP", false},
+		{"malformed role", []string{"A:A1:Admin PPE"}, "A1:PP", false},
+		{"KLPD-wide Admin PPE grants in every satuan kerja", []string{"A:*:Admin PPE"}, "A:A2:PPK", true},
+		{"KLPD-wide Admin PPE only in its KLPD", []string{"A:*:Admin PPE"}, "B:A1:PPK", false},
+		{"KLPD-wide Admin PPE grants KLPD-wide Admin Agency", []string{"A:*:Admin PPE"}, "A:*:Admin Agency", true},
+		{"Admin PPE may not grant KLPD-wide roles", []string{"A:A1:Admin PPE"}, "A:*:Admin Agency", false},
+		{"only granter functions are KLPD-wide", []string{"A:*:Admin PPE"}, "A:*:PPK", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := p.CanGrant(tt.granter, tt.role)
+			if (v == nil) != tt.allowed {
+				t.Fatalf("expected allowed=%v, got %v", tt.allowed, v)
+			}
+			// roles are removed by those who may grant them
+			if revoke := p.CanRevoke(tt.granter, tt.role); (revoke == nil) != tt.allowed {
+				t.Fatalf("expected removal allowed=%v, got %v", tt.allowed, revoke)
+			}
+		})
+	}
+
+	if v := p.CanRevoke([]string{"A:A1:Admin Agency"}, "A:A1:Admin Agency"); v == nil || v.Code != CodeRevokeDenied {
+		t.Fatalf("expected %s, got %+v", CodeRevokeDenied, v)
+	}
+}
+
+func TestParseRoleName(t *testing.T) {
+	tests := []struct {
+		input string
+		want  RoleName
+		str   string
+	}{
+		{"A:A1:Admin PPE", RoleName{"A", "A1", "Admin PPE"}, "A:A1:Admin PPE"},
+		{"  a : a1 :  Admin   PPE ", RoleName{"A", "A1", "Admin PPE"}, "A:A1:Admin PPE"},
+		{`K1:Biro\: Umum:PP`, RoleName{"K1", "BIRO: UMUM", "PP"}, `K1:BIRO\: UMUM:PP`},
+		{`K1:A\\B:PP`, RoleName{"K1", `A\B`, "PP"}, `K1:A\\B:PP`},
+	}
+	for _, tt := range tests {
+		got, err := ParseRoleName(tt.input)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		if got != tt.want || got.String() != tt.str {
+			t.Fatalf("%q: got %+v (%s), want %+v (%s)", tt.input, got, got, tt.want, tt.str)
+		}
+		if again, _ := ParseRoleName(got.String()); again != got {
+			t.Fatalf("%q: %s does not round trip", tt.input, got)
+		}
+	}
+
+	for _, input := range []string{"A1:PP", "A:A1:B:PP", "A::PP", "A:A1: ", `A:A1:PP\`, "*:A1:PP"} {
+		if _, err := ParseRoleName(input); err == nil {
+			t.Fatalf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestParseRoleFunctionCase(t *testing.T) {
+	p, err := Load("../../policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, v := p.ParseRole("a:a1:admin ppe")
+	if v != nil || r.String() != "A:A1:Admin PPE" {
+		t.Fatalf("unexpected role %s: %v", r, v)
+	}
+	if _, v := p.ParseRole("A:A1:Admin"); v == nil || v.Code != CodeUnknownFunction {
+		t.Fatalf("expected unknown function, got %v", v)
+	}
+	if r, v := p.ParseRole("a:*:admin ppe"); v != nil || !r.KLPDWide() || r.String() != "A:*:Admin PPE" {
+		t.Fatalf("unexpected KLPD-wide role %s: %v", r, v)
+	}
+	if _, v := p.ParseRole("A:*:PP"); v == nil || v.Code != CodeInvalidRole {
+		t.Fatalf("expected an invalid KLPD-wide role, got %v", v)
+	}
+}
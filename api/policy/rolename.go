@@ -0,0 +1,171 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RoleName is a role "{KLPD}:{satuanKerja}:{function}", e.g. "A:A1:Admin PPE".
+//
+// A ':' or '\' inside a part is escaped with a backslash, e.g. `K1:Biro\: Umum:PP`.
+// The satuanKerja AllSatuanKerja makes a KLPD-wide role, e.g. "A:*:Admin PPE",
+// which is held in every satuanKerja of the KLPD.
+// Every role string must be parsed with ParseRoleName (or Policy.ParseRole) so
+// that the same role is never interpreted two different ways.
+type RoleName struct {
+	KLPD        string
+	SatuanKerja string
+	Function    string
+}
+
+// AllSatuanKerja is the satuanKerja of KLPD-wide roles
+const AllSatuanKerja = "*"
+
+// ParseRoleName parses and normalizes a role string:
+// whitespace around and inside each part is collapsed to a single space,
+// and KLPD and satuanKerja codes are upper-cased.
+func ParseRoleName(s string) (RoleName, error) {
+	parts, ok := splitParts(s)
+	if !ok || len(parts) != 3 {
+		return RoleName{}, fmt.Errorf("Role %s is not in correct format", s)
+	}
+
+	r := RoleName{
+		KLPD:        NormalizeCode(parts[0]),
+		SatuanKerja: NormalizeCode(parts[1]),
+		Function:    normalizeSpace(parts[2]),
+	}
+	if err := r.Validate(); err != nil {
+		return RoleName{}, fmt.Errorf("Role %s is not in correct format: %w", s, err)
+	}
+	return r, nil
+}
+
+// NormalizeCode normalizes a single, unescaped KLPD or satuanKerja code like ParseRoleName:
+// whitespace is collapsed to a single space and the code is upper-cased
+func NormalizeCode(code string) string {
+	return strings.ToUpper(normalizeSpace(code))
+}
+
+// ParseScope parses a "{KLPD}:{satuanKerja}" prefix, normalized like ParseRoleName.
+// The result has an empty Function.
+func ParseScope(s string) (RoleName, error) {
+	parts, ok := splitParts(s)
+	if !ok || len(parts) != 2 {
+		return RoleName{}, fmt.Errorf("Satuan kerja %s is not in correct format", s)
+	}
+
+	r := RoleName{
+		KLPD:        NormalizeCode(parts[0]),
+		SatuanKerja: NormalizeCode(parts[1]),
+	}
+	if r.KLPD == "" || r.SatuanKerja == "" {
+		return RoleName{}, fmt.Errorf("Satuan kerja %s is not in correct format", s)
+	}
+	return r, nil
+}
+
+// String formats the role, escaping ':' and '\' inside its parts
+func (r RoleName) String() string {
+	return escape(r.KLPD) + ":" + escape(r.SatuanKerja) + ":" + escape(r.Function)
+}
+
+// Scope returns the "{KLPD}:{satuanKerja}" prefix of the role
+func (r RoleName) Scope() string {
+	return escape(r.KLPD) + ":" + escape(r.SatuanKerja)
+}
+
+// KLPDWide is true if the role is held in every satuanKerja of its KLPD
+func (r RoleName) KLPDWide() bool {
+	return r.SatuanKerja == AllSatuanKerja
+}
+
+// Covers is true if the role's satuanKerja includes the satuanKerja of other:
+// the same one, or any satuanKerja of the same KLPD if the role is KLPD-wide
+func (r RoleName) Covers(other RoleName) bool {
+	return r.KLPD == other.KLPD && (r.KLPDWide() || r.SatuanKerja == other.SatuanKerja)
+}
+
+// Validate checks that no part of the role is empty and that the KLPD is not a wildcard
+func (r RoleName) Validate() error {
+	if r.KLPD == "" {
+		return fmt.Errorf("KLPD cannot be empty")
+	}
+	if r.KLPD == AllSatuanKerja {
+		return fmt.Errorf("KLPD cannot be %s", AllSatuanKerja)
+	}
+	if r.SatuanKerja == "" {
+		return fmt.Errorf("satuan kerja cannot be empty")
+	}
+	if r.Function == "" {
+		return fmt.Errorf("role function cannot be empty")
+	}
+	return nil
+}
+
+// ParseRole parses a role string with ParseRoleName and resolves its function
+// case-insensitively against the functions of the policy.
+// Only granter functions of the delegation rules may be held KLPD-wide.
+func (p *Policy) ParseRole(s string) (RoleName, *Violation) {
+	r, err := ParseRoleName(s)
+	if err != nil {
+		return RoleName{}, &Violation{
+			Code:    CodeInvalidRole,
+			Roles:   []string{s},
+			Message: err.Error(),
+		}
+	}
+
+	function, ok := p.function[strings.ToLower(r.Function)]
+	if !ok {
+		return RoleName{}, &Violation{
+			Code:    CodeUnknownFunction,
+			KLPD:    r.KLPD,
+			Roles:   []string{s},
+			Message: fmt.Sprintf("Role Function not found: %s", r.Function),
+		}
+	}
+	r.Function = function
+
+	if _, ok := p.delegation[function]; r.KLPDWide() && !ok {
+		return RoleName{}, &Violation{
+			Code:    CodeInvalidRole,
+			KLPD:    r.KLPD,
+			Roles:   []string{s},
+			Message: fmt.Sprintf("Role %s is not in correct format: only granter functions may be held KLPD-wide", s),
+		}
+	}
+	return r, nil
+}
+
+// Splits s at every unescaped ':' and unescapes the parts.
+// Returns false if s ends with a dangling backslash.
+func splitParts(s string) ([]string, bool) {
+	parts := make([]string, 0, 3)
+	var part strings.Builder
+	escaped := false
+	for _, ch := range s {
+		switch {
+		case escaped:
+			part.WriteRune(ch)
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case ch == ':':
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteRune(ch)
+		}
+	}
+	parts = append(parts, part.String())
+	return parts, !escaped
+}
+
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace(s)
+}
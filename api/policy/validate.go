@@ -0,0 +1,231 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Violation codes
+const (
+	CodeInvalidRole      = "invalid_role_format"   // the role is not "{KLPD}:{satuanKerja}:{function}", or KLPD-wide without a granter function
+	CodeUnknownFunction  = "unknown_role_function" // the role function is not in the policy
+	CodeExclusive        = "sod_exclusive"         // broke an Exclusive rule
+	CodeAtMost           = "sod_at_most"           // broke an AtMost rule
+	CodeRequires         = "sod_requires"          // broke a Requires rule
+	CodeGrantDenied      = "grant_denied"          // the assigner may not grant the role
+	CodeRevokeDenied     = "revoke_denied"         // the assigner may not remove the role
+	CodeSelfModification = "self_modification"     // the assigner may not change their own roles without an approver
+)
+
+// Violation is a machine readable reason why a set of roles is not allowed
+type Violation struct {
+	Code        string   `json:"code"`
+	Rule        string   `json:"rule,omitempty"` // id of the broken rule
+	KLPD        string   `json:"klpd,omitempty"`
+	SatuanKerja string   `json:"satuan_kerja,omitempty"`
+	Roles       []string `json:"roles"` // the offending roles
+	Message     string   `json:"message"`
+}
+
+func (v *Violation) Error() string {
+	if v.Rule != "" {
+		return v.Rule + ": " + v.Message
+	}
+	return v.Message
+}
+
+// A parsed role together with the role string it was parsed from
+type role struct {
+	RoleName
+	Name string
+}
+
+// Takes a list of rolenames which is to be assigned to a single user
+// and checks whether such combination of roles violates the rules of the policy
+func (p *Policy) ValidateRoles(rolenames []string) []*Violation {
+	// no roles => no issue
+	if rolenames == nil || len(rolenames) == 0 {
+		return nil
+	}
+
+	violations := make([]*Violation, 0)
+	roles := make([]role, 0, len(rolenames))
+	for _, rolename := range rolenames {
+		r, v := p.ParseRole(rolename)
+		if v != nil {
+			violations = append(violations, v)
+			continue
+		}
+		roles = append(roles, role{RoleName: r, Name: rolename})
+	}
+
+	if len(violations) != 0 {
+		return violations
+	}
+
+	for _, rule := range p.Rules {
+		violations = append(violations, p.checkRule(rule, roles)...)
+	}
+
+	if len(violations) != 0 {
+		return violations
+	}
+
+	return nil
+}
+
+// Evaluates rule on every group of roles in the rule's scope
+func (p *Policy) checkRule(rule Rule, roles []role) []*Violation {
+	groups := make(map[string][]role)
+	wide := make([]role, 0)
+	for _, r := range roles {
+		if len(rule.KLPD) > 0 && !contains(rule.KLPD, r.KLPD) {
+			continue
+		}
+
+		var scope string
+		switch rule.Scope {
+		case ScopeKLPD:
+			scope = r.KLPD
+		case ScopeSatuanKerja:
+			if r.KLPDWide() {
+				wide = append(wide, r)
+				continue
+			}
+			scope = r.Scope()
+		}
+		groups[scope] = append(groups[scope], r)
+	}
+	// a KLPD-wide role is held in every satuan kerja of its KLPD the user has roles in,
+	// or forms a group of its own if there is none
+	for _, r := range wide {
+		held := false
+		for scope, group := range groups {
+			if r.Covers(group[0].RoleName) && !group[0].KLPDWide() {
+				groups[scope] = append(group, r)
+				held = true
+			}
+		}
+		if !held {
+			groups[r.Scope()] = append(groups[r.Scope()], r)
+		}
+	}
+
+	scopes := make([]string, 0, len(groups))
+	for scope := range groups {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+
+	violations := make([]*Violation, 0)
+	for _, scope := range scopes {
+		group := groups[scope]
+
+		// held[roleFunction] is true IFF the user has "roleFunction" within "scope"
+		held := make(map[string]bool)
+		for _, r := range group {
+			held[r.Function] = true
+		}
+
+		v := &Violation{Rule: rule.ID}
+		var where string
+		if rule.Scope != ScopeGlobal {
+			where = " in " + scope
+			v.KLPD = group[0].KLPD
+		}
+		if rule.Scope == ScopeSatuanKerja {
+			v.SatuanKerja = group[0].SatuanKerja
+		}
+
+		switch rule.Type {
+		case Exclusive, AtMost:
+			members := p.heldMembers(rule, held)
+			max := rule.Max
+			if rule.Type == Exclusive {
+				max = 1
+			}
+			if len(members) <= max {
+				continue
+			}
+
+			for _, r := range group {
+				member := r.Function
+				if len(rule.Divisions) > 0 {
+					member = p.division[r.Function]
+				}
+				if contains(members, member) {
+					v.Roles = append(v.Roles, r.Name)
+				}
+			}
+			if len(rule.Divisions) > 0 && rule.Type == Exclusive {
+				v.Code = CodeExclusive
+				v.Message = fmt.Sprintf("User's roles%s may not cross-function different division: %s", where, strings.Join(members, ", "))
+			} else if rule.Type == Exclusive {
+				v.Code = CodeExclusive
+				v.Message = fmt.Sprintf("User's roles%s may not contain %s at the same time", where, strings.Join(members, " and "))
+			} else {
+				v.Code = CodeAtMost
+				v.Message = fmt.Sprintf("User's roles%s may contain at most %d of %s, got: %s", where, max, strings.Join(append(rule.Functions, rule.Divisions...), ", "), strings.Join(members, ", "))
+			}
+
+		case Requires:
+			triggers := make([]string, 0)
+			for _, function := range rule.Functions {
+				if held[function] {
+					triggers = append(triggers, function)
+				}
+			}
+			missing := make([]string, 0)
+			for _, function := range rule.Requires {
+				if !held[function] {
+					missing = append(missing, function)
+				}
+			}
+			if len(triggers) == 0 || len(missing) == 0 {
+				continue
+			}
+
+			for _, r := range group {
+				if contains(triggers, r.Function) {
+					v.Roles = append(v.Roles, r.Name)
+				}
+			}
+			v.Code = CodeRequires
+			v.Message = fmt.Sprintf("User's roles%s with %s also require %s", where, strings.Join(triggers, ", "), strings.Join(missing, ", "))
+		}
+		violations = append(violations, v)
+	}
+	return violations
+}
+
+// Returns the members of rule which are held, in the order they are listed in the rule.
+// A division is held if any of its functions is held
+func (p *Policy) heldMembers(rule Rule, held map[string]bool) []string {
+	members := make([]string, 0)
+	for _, function := range rule.Functions {
+		if held[function] {
+			members = append(members, function)
+		}
+	}
+
+	heldDivisions := make(map[string]bool)
+	for function := range held {
+		heldDivisions[p.division[function]] = true
+	}
+	for _, div := range rule.Divisions {
+		if heldDivisions[div] {
+			members = append(members, div)
+		}
+	}
+	return members
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package provision
+
+import (
+	"fmt"
+	"io"
+
+	"spse-role-poc/api/manager"
+	"spse-role-poc/api/policy"
+)
+
+// Plan is the difference between the desired and the actual role catalog
+type Plan struct {
+	Create []manager.Role // missing roles, without ID
+	Update []Update       // roles whose description drifted
+	Extra  []manager.Role // roles following the policy's naming scheme which are not in the registry
+}
+
+// Update changes the description of an existing role
+type Update struct {
+	Role        manager.Role
+	Description string
+}
+
+// Empty is true if the catalog is in sync
+func (p *Plan) Empty() bool {
+	return len(p.Create) == 0 && len(p.Update) == 0 && len(p.Extra) == 0
+}
+
+// Desired returns the role catalog described by the registry and the policy, sorted by role.Name.
+// Besides the roles of every satuan kerja, every KLPD has a KLPD-wide role of each granter function.
+func Desired(reg *Registry, pol *policy.Policy) []manager.Role {
+	roles := make([]manager.Role, 0)
+	for _, klpd := range reg.KLPD {
+		for _, function := range pol.Granters() {
+			name := policy.RoleName{KLPD: klpd.Code, SatuanKerja: policy.AllSatuanKerja, Function: function}
+			roles = append(roles, manager.Role{
+				Name:        name.String(),
+				Description: fmt.Sprintf("%s - every satuan kerja (%s)", function, klpd.Name),
+			})
+		}
+		for _, satker := range klpd.SatuanKerja {
+			for _, function := range pol.Functions() {
+				name := policy.RoleName{KLPD: klpd.Code, SatuanKerja: satker.Code, Function: function}
+				roles = append(roles, manager.Role{
+					Name:        name.String(),
+					Description: fmt.Sprintf("%s - %s (%s)", function, satker.Name, klpd.Name),
+				})
+			}
+		}
+	}
+	return roles
+}
+
+// Compute compares the desired catalog with the actual one.
+// Roles of the catalog which do not follow the policy's naming scheme are not managed and ignored.
+func Compute(reg *Registry, pol *policy.Policy, catalog []manager.Role) *Plan {
+	actual := make(map[string]manager.Role)
+	for _, role := range catalog {
+		actual[role.Name] = role
+	}
+
+	plan := &Plan{}
+	desired := make(map[string]bool)
+	for _, role := range Desired(reg, pol) {
+		desired[role.Name] = true
+		existing, ok := actual[role.Name]
+		if !ok {
+			plan.Create = append(plan.Create, role)
+		} else if existing.Description != role.Description {
+			plan.Update = append(plan.Update, Update{Role: existing, Description: role.Description})
+		}
+	}
+
+	for _, role := range catalog {
+		if _, v := pol.ParseRole(role.Name); v == nil && !desired[role.Name] {
+			plan.Extra = append(plan.Extra, role)
+		}
+	}
+	return plan
+}
+
+// Print writes the plan in a human readable form
+func (p *Plan) Print(w io.Writer) {
+	for _, role := range p.Create {
+		fmt.Fprintf(w, "+ %s\t%q\n", role.Name, role.Description)
+	}
+	for _, update := range p.Update {
+		fmt.Fprintf(w, "~ %s\tdescription %q -> %q\n", update.Role.Name, update.Role.Description, update.Description)
+	}
+	for _, role := range p.Extra {
+		fmt.Fprintf(w, "- %s\tnot in registry\n", role.Name)
+	}
+	fmt.Fprintf(w, "Plan: %d to create, %d to update, %d extra.\n", len(p.Create), len(p.Update), len(p.Extra))
+}
+
+// Apply creates the missing roles and updates drifted descriptions.
+// Extra roles are only deleted if prune is set, since users may still hold them.
+// Applying a plan computed from the current catalog is idempotent.
+func (p *Plan) Apply(dir manager.Directory, prune bool) error {
+	for _, role := range p.Create {
+		if _, err := dir.CreateRole(role.Name, role.Description); err != nil {
+			return fmt.Errorf("create %s: %w", role.Name, err)
+		}
+	}
+	for _, update := range p.Update {
+		if err := dir.UpdateRoleDescription(update.Role.ID, update.Description); err != nil {
+			return fmt.Errorf("update %s: %w", update.Role.Name, err)
+		}
+	}
+	if prune {
+		for _, role := range p.Extra {
+			if err := dir.DeleteRole(role.ID); err != nil {
+				return fmt.Errorf("delete %s: %w", role.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Sync computes the plan against the current catalog of dir and applies it
+func Sync(dir manager.Directory, reg *Registry, pol *policy.Policy, prune bool) (*Plan, error) {
+	catalog, err := dir.ListRoles()
+	if err != nil {
+		return nil, err
+	}
+	plan := Compute(reg, pol, catalog)
+	return plan, plan.Apply(dir, prune)
+}
@@ -0,0 +1,70 @@
+package provision
+
+import (
+	"testing"
+
+	"spse-role-poc/api/manager"
+	"spse-role-poc/api/policy"
+)
+
+func TestPlanAndApply(t *testing.T) {
+	pol, err := policy.Load("../../policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := LoadRegistry("../../orgs.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A:A1:PP exists with a placeholder description, C:C1:PP is not in the registry
+	// and "Tenant Admin" does not follow the policy's naming scheme
+	dir := manager.NewMemoryDirectory("A:A1:PP", "C:C1:PP", "Tenant Admin")
+	catalog, _ := dir.ListRoles()
+	plan := Compute(reg, pol, catalog)
+
+	want := len(reg.KLPD) * (3*len(pol.Functions()) + len(pol.Granters()))
+	if len(plan.Create) != want-1 {
+		t.Fatalf("expected %d roles to create, got %d", want-1, len(plan.Create))
+	}
+	if len(plan.Update) != 1 || plan.Update[0].Role.Name != "A:A1:PP" || plan.Update[0].Description != "PP - Satuan Kerja A1 (KLPD A)" {
+		t.Fatalf("unexpected updates: %+v", plan.Update)
+	}
+	if len(plan.Extra) != 1 || plan.Extra[0].Name != "C:C1:PP" {
+		t.Fatalf("unexpected extra roles: %+v", plan.Extra)
+	}
+
+	if err := plan.Apply(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	catalog, _ = dir.ListRoles()
+	plan = Compute(reg, pol, catalog)
+	if len(plan.Create) != 0 || len(plan.Update) != 0 || len(plan.Extra) != 1 {
+		t.Fatalf("expected only the extra role to remain, got %+v", plan)
+	}
+
+	// applying again with prune converges to an empty plan
+	if _, err := Sync(dir, reg, pol, true); err != nil {
+		t.Fatal(err)
+	}
+	catalog, _ = dir.ListRoles()
+	if plan := Compute(reg, pol, catalog); !plan.Empty() {
+		t.Fatalf("expected an empty plan, got %+v", plan)
+	}
+	if len(catalog) != want+1 {
+		t.Fatalf("expected %d roles, got %d", want+1, len(catalog))
+	}
+}
+
+func TestRegistryValidate(t *testing.T) {
+	reg := &Registry{
+		Version: 1,
+		KLPD: []KLPD{
+			{Code: "A", SatuanKerja: []SatuanKerja{{Code: "A1"}, {Code: "A1"}}},
+			{Code: "b"},
+		},
+	}
+	if err := reg.Validate(); err == nil {
+		t.Fatal("expected duplicate satuan kerja and lower-case KLPD to be rejected")
+	}
+}
@@ -0,0 +1,89 @@
+// Package provision keeps the identity provider's role catalog in sync with the
+// organization registry: every role function of the policy is provisioned as
+// a role "{KLPD}:{satuanKerja}:{function}" for every satuan kerja of every KLPD,
+// and every granter function as a KLPD-wide role "{KLPD}:*:{function}" of every KLPD.
+package provision
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"spse-role-poc/api/policy"
+)
+
+// Registry is the organization registry: the KLPD and their satuan kerja (see orgs.yaml)
+type Registry struct {
+	Version int    `yaml:"version"`
+	KLPD    []KLPD `yaml:"klpd"`
+}
+
+type KLPD struct {
+	Code        string        `yaml:"code"`
+	Name        string        `yaml:"name"`
+	SatuanKerja []SatuanKerja `yaml:"satuan_kerja"`
+}
+
+type SatuanKerja struct {
+	Code string `yaml:"code"`
+	Name string `yaml:"name"`
+}
+
+// LoadRegistry reads and validates the registry file at path
+func LoadRegistry(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("registry: %w", err)
+	}
+
+	var reg Registry
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&reg); err != nil {
+		return nil, fmt.Errorf("registry %s: invalid YAML: %w", path, err)
+	}
+	if err := reg.Validate(); err != nil {
+		return nil, fmt.Errorf("registry %s: %w", path, err)
+	}
+	return &reg, nil
+}
+
+// Validate checks that codes are unique and already in the normalized form of policy.RoleName
+func (reg *Registry) Validate() error {
+	errs := make([]error, 0)
+	if reg.Version != 1 {
+		errs = append(errs, fmt.Errorf("version: unsupported registry version %d, expected 1", reg.Version))
+	}
+
+	klpdCodes := make(map[string]bool)
+	for i, klpd := range reg.KLPD {
+		if err := checkCode(klpd.Code); err != nil {
+			errs = append(errs, fmt.Errorf("klpd[%d]: %w", i, err))
+		} else if klpdCodes[klpd.Code] {
+			errs = append(errs, fmt.Errorf("klpd[%d]: duplicate KLPD %q", i, klpd.Code))
+		}
+		klpdCodes[klpd.Code] = true
+
+		satkerCodes := make(map[string]bool)
+		for j, satker := range klpd.SatuanKerja {
+			if err := checkCode(satker.Code); err != nil {
+				errs = append(errs, fmt.Errorf("klpd[%d].satuan_kerja[%d]: %w", i, j, err))
+			} else if satkerCodes[satker.Code] {
+				errs = append(errs, fmt.Errorf("klpd[%d].satuan_kerja[%d]: duplicate satuan kerja %q in KLPD %q", i, j, satker.Code, klpd.Code))
+			}
+			satkerCodes[satker.Code] = true
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkCode(code string) error {
+	r, err := policy.ParseRoleName(code + ":X:X")
+	if err != nil || r.KLPD != code {
+		return fmt.Errorf("code %q must be non-empty, upper-case, without surrounding spaces and not %s", code, policy.AllSatuanKerja)
+	}
+	return nil
+}
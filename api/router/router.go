@@ -1,16 +1,22 @@
 package router
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
 
 	"spse-role-poc/api/manager"
 	"spse-role-poc/api/middleware"
 )
 
-func New() http.Handler {
+// Creates the API router; every handler talks to the identity provider through `svc.Dir`,
+// validates role combinations against `svc.Policy` and records mutations to `svc.Audit`
+func New(svc *manager.Service) http.Handler {
 	r := chi.NewRouter()
+	// the request id is recorded in the audit log and returned as X-Request-Id
+	r.Use(chimiddleware.RequestID, requestIDHeader)
 
 	// publicly accessible - to test the api is responding
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
@@ -19,16 +25,48 @@ func New() http.Handler {
 		w.Write([]byte(`{"message":"Hello World!"}`))
 	})
 
-	// user functions
-	r.Post("/create", manager.CreateUserHandler)
-	r.Patch("/addroles", manager.AddRolesHandler)
-	r.Patch("/rewriteroles", manager.RewriteRolesHandler)
+	// every management route requires a valid token granted the scope of the route,
+	// the scopes are listed in the README
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.EnsureValidToken())
+		scope := middleware.RequireScope
+		// the roles granted and removed by these routes are checked against the roles of the assigner,
+		// every route granting or removing roles, or answering what the assigner may grant, must use it
+		assigner := middleware.ValidateRoles(svc.Dir)
 
-	r.Route("/", func(r chi.Router) {
-		r.Use(middleware.ValidateRoles)
-		// r.Use(middleware.EnsureValidToken())
-		r.Post("/create-protected", manager.CreateUserHandler)
+		// user functions
+		r.With(scope(middleware.ScopeUsersWrite), assigner).Post("/create", svc.CreateUserHandler)
+		r.With(scope(middleware.ScopeUsersWrite), assigner).Patch("/addroles", svc.AddRolesHandler)
+		r.With(scope(middleware.ScopeUsersWrite), assigner).Patch("/rewriteroles", svc.RewriteRolesHandler)
+		r.With(scope(middleware.ScopeUsersRead)).Get("/users/{id}/roles", svc.UserRolesHandler)
+		r.With(scope(middleware.ScopeUsersDelete), assigner).Delete("/deleteuser", svc.DeleteUser)
+
+		// who holds, and who may grant, a role or the roles of a satuan kerja
+		r.With(scope(middleware.ScopeRolesRead)).Get("/roles/holders", svc.RoleHoldersHandler)
+
+		// audit log
+		r.With(scope(middleware.ScopeAuditRead)).Get("/audit", svc.AuditHandler)
+
+		// runtime metrics, e.g. the hit rate of the role catalog; they include the command line of the process
+		r.With(scope(middleware.ScopeMetricsRead)).Handle("/debug/vars", expvar.Handler())
+
+		// authorization decisions and grantable roles for the assigner of the token
+		r.With(scope(middleware.ScopeRolesRead), assigner).Post("/v1/decisions", svc.DecisionsHandler)
+		r.With(scope(middleware.ScopeRolesRead), assigner).Get("/v1/grantable-roles", svc.GrantableRolesHandler)
+
+		// approvals of changes of assigners' own roles, checked against the roles of the approver
+		r.With(scope(middleware.ScopeUsersWrite), assigner).Post("/v1/approvals", svc.ApprovalsHandler)
+
+		r.With(scope(middleware.ScopeUsersWrite), assigner).Post("/create-protected", svc.CreateUserHandler)
 	})
 
 	return r
 }
+
+// Returns the request id set by chimiddleware.RequestID to the caller
+func requestIDHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(chimiddleware.RequestIDHeader, chimiddleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/manager"
+	"spse-role-poc/api/policy"
+	"spse-role-poc/api/provision"
+)
+
+// provision [-apply] [-prune]
+//
+// Prints the difference between the role catalog and the roles described by
+// the registry and the policy: missing roles (+), description drift (~) and
+// extra roles (-). With -apply the missing roles are created and descriptions
+// updated; extra roles are only deleted with -prune.
+func provisionCommand(dir manager.Directory, reg *provision.Registry, pol *policy.Policy, args []string) {
+	flags := flag.NewFlagSet("provision", flag.ExitOnError)
+	apply := flags.Bool("apply", false, "apply the plan")
+	prune := flags.Bool("prune", false, "with -apply, delete roles which are not in the registry")
+	flags.Parse(args)
+
+	catalog, err := dir.ListRoles()
+	if err != nil {
+		log.Fatal("Error listing role catalog: ", err)
+	}
+	plan := provision.Compute(reg, pol, catalog)
+	plan.Print(os.Stdout)
+
+	if !*apply || plan.Empty() {
+		return
+	}
+	if err := plan.Apply(dir, *prune); err != nil {
+		log.Fatal("Error applying plan: ", err)
+	}
+	log.Print("Plan applied")
+}
+
+// verify-audit [-public-key key]
+//
+// Checks that the existing audit log of AUDIT_SINK and AUDIT_FILE, opened read-only, is an unbroken hash chain
+// and that its signatures are valid for the public key (defaults to AUDIT_PUBLIC_KEY,
+// or the public key of AUDIT_SIGNING_KEY). Prints every problem found and exits with
+// status 1 if there is any.
+func verifyAuditCommand(args []string) {
+	flags := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	publicKey := flags.String("public-key", os.Getenv("AUDIT_PUBLIC_KEY"), "base64 encoded Ed25519 public key")
+	flags.Parse(args)
+
+	var pub ed25519.PublicKey
+	var err error
+	if *publicKey != "" {
+		pub, err = audit.ParsePublicKey(*publicKey)
+	} else if seed := os.Getenv("AUDIT_SIGNING_KEY"); seed != "" {
+		var key ed25519.PrivateKey
+		key, err = audit.ParsePrivateKey(seed)
+		if err == nil {
+			pub = key.Public().(ed25519.PublicKey)
+		}
+	}
+	if err != nil {
+		log.Fatal("Error parsing key: ", err)
+	}
+
+	// the log is opened read-only, so that a copy on a read-only mount can be verified
+	// and the verification never modifies the log it checks
+	kind := getenv("AUDIT_SINK", "jsonl")
+	sink, err := audit.OpenReadOnly(kind, getenv("AUDIT_FILE", "audit."+kind))
+	if err != nil {
+		log.Fatal("Error opening audit log: ", err)
+	}
+	defer sink.Close()
+
+	report, err := audit.Verify(sink, pub)
+	if err != nil {
+		log.Fatal("Error reading audit log: ", err)
+	}
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%d events, %d problems\n", report.Events, len(report.Problems))
+	if pub == nil {
+		fmt.Println("No public key given, signatures were not checked")
+	} else if report.SignedSeq == 0 {
+		fmt.Println("No valid signature found")
+	} else {
+		fmt.Printf("Signed up to seq %d, %d events after it are only hash-chained\n", report.SignedSeq, report.Unsigned())
+	}
+
+	if len(report.Problems) > 0 {
+		sink.Close()
+		os.Exit(1)
+	}
+}
+
+// audit-keygen
+//
+// Prints a new Ed25519 key pair, to be set as AUDIT_SIGNING_KEY of the API
+// and AUDIT_PUBLIC_KEY of the auditors running verify-audit
+func auditKeygenCommand() {
+	private, public, err := audit.GenerateKey()
+	if err != nil {
+		log.Fatal("Error generating key: ", err)
+	}
+	fmt.Printf("AUDIT_SIGNING_KEY=%s\nAUDIT_PUBLIC_KEY=%s\n", private, public)
+}
@@ -1,47 +1,166 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"spse-role-poc/api/audit"
 	"spse-role-poc/api/manager"
+	"spse-role-poc/api/policy"
+	"spse-role-poc/api/provision"
 	"spse-role-poc/api/router"
 
-	// "github.com/auth0/go-auth0"
-	// "github.com/auth0/go-auth0/management"
 	"github.com/joho/godotenv"
 )
 
+// Usage:
+//
+//	go run .                              starts the API
+//	go run . provision [-apply] [-prune]  syncs the role catalog with the registry, see provisionCommand
+//	go run . verify-audit [-public-key]   verifies the hash chain of the audit log, see verifyAuditCommand
+//	go run . audit-keygen                 prints a new signing key for the audit log
 func main() {
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
 
-	manager.ConnectAPI()
-	manager.RoleSetup()
-
-	// // generate roles in auth0;
-	// available_roles := []string{"Admin PPE", "Admin Agency", "Verifikator", "Helpdesk", "PPK", "KUPBJ", "Anggota Pokmil", "PP", "Auditor"}
-	// for ch := 'A'; ch <= 'B'; ch++ {
-	// 	for i := 1; i <= 3; i++ {
-	// 		for _, role := range available_roles {
-	// 			KLPD := string(ch)
-	// 			satuanKerja := "A" + strconv.Itoa(i)
-	// 			roleFunction := role
-	// 			newRole := &management.Role{
-	// 				Name:        auth0.String(KLPD + ":" + satuanKerja + ":" + roleFunction),
-	// 				Description: auth0.String("Placeholder Description"),
-	// 			}
-	// 			manager.Auth0API.Role.Create(newRole)
-	// 		}
-	// 	}
-	// }
-	// return
-
-	r := router.New()
+	// commands which only need the audit log
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify-audit":
+			verifyAuditCommand(os.Args[2:])
+			return
+		case "audit-keygen":
+			auditKeygenCommand()
+			return
+		}
+	}
+
+	pol, err := policy.Load(getenv("POLICY_FILE", "policy.yaml"))
+	if err != nil {
+		log.Fatal("Error loading role policy: ", err)
+	}
+	reg, err := provision.LoadRegistry(getenv("REGISTRY_FILE", "orgs.yaml"))
+	if err != nil {
+		log.Fatal("Error loading organization registry: ", err)
+	}
+
+	ttl, err := time.ParseDuration(getenv("ROLE_CATALOG_TTL", manager.DefaultCatalogTTL.String()))
+	if err != nil {
+		log.Fatal("Error parsing ROLE_CATALOG_TTL: ", err)
+	}
+
+	// DIRECTORY=memory runs the API offline against an in-memory role catalog
+	// The role catalog is cached in memory, see manager.Catalog
+	var dir *manager.Catalog
+	if os.Getenv("DIRECTORY") == "memory" {
+		dir = manager.NewCatalog(manager.NewMemoryDirectory(), ttl)
+		if _, err := provision.Sync(dir, reg, pol, false); err != nil {
+			log.Fatal("Error provisioning in-memory role catalog: ", err)
+		}
+	} else {
+		dir = manager.NewCatalog(manager.ConnectAPI(), ttl)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "provision":
+			provisionCommand(dir, reg, pol, os.Args[2:])
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+		return
+	}
+
+	svc := manager.NewService(dir, pol)
+	// OPERATORS lists the user ids which may grant and remove any role, comma separated
+	for _, uid := range strings.Split(os.Getenv("OPERATORS"), ",") {
+		if uid = strings.TrimSpace(uid); uid != "" {
+			svc.Operators = append(svc.Operators, uid)
+		}
+	}
+	if len(svc.Operators) > 0 {
+		log.Printf("Operators, whose requests are not checked against the delegation rules: %s", strings.Join(svc.Operators, ", "))
+	}
+	// AUDIT_SINK=none disables the audit log
+	if getenv("AUDIT_SINK", "jsonl") != "none" {
+		sink, err := openAuditSink()
+		if err != nil {
+			log.Fatal("Error opening audit log: ", err)
+		}
+		var key ed25519.PrivateKey
+		if seed := os.Getenv("AUDIT_SIGNING_KEY"); seed != "" {
+			if key, err = audit.ParsePrivateKey(seed); err != nil {
+				log.Fatal("Error parsing AUDIT_SIGNING_KEY: ", err)
+			}
+		} else {
+			log.Print("AUDIT_SIGNING_KEY is not set, the audit log is hash-chained but not signed")
+		}
+		chain, err := audit.NewChain(sink, key)
+		if err != nil {
+			log.Fatal("Error reading audit log: ", err)
+		}
+		svc.Audit = chain
+	}
+
 	port := os.Getenv("API_PORT")
+	server := &http.Server{Addr: ":" + port, Handler: router.New(svc)}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
 	log.Printf("Starting up on http://localhost:%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+
+	// on SIGINT or SIGTERM, finish the requests in flight, then close the audit log
+	// so that no event is lost; log.Fatal would exit without running deferred calls
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-errs:
+		closeAudit(svc)
+		log.Fatal("Error serving: ", err)
+	case <-ctx.Done():
+	}
+
+	log.Print("Shutting down")
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdown); err != nil {
+		log.Print("Error shutting down: ", err)
+	}
+	closeAudit(svc)
+}
+
+// How long requests in flight may take to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+func closeAudit(svc *manager.Service) {
+	if svc.Audit == nil {
+		return
+	}
+	if err := svc.Audit.Close(); err != nil {
+		log.Print("Error closing audit log: ", err)
+	}
+}
+
+// Opens the audit log of AUDIT_SINK (jsonl or sqlite) at AUDIT_FILE
+func openAuditSink() (audit.Sink, error) {
+	kind := getenv("AUDIT_SINK", "jsonl")
+	return audit.Open(kind, getenv("AUDIT_FILE", "audit."+kind))
+}
+
+// Returns the environment variable `key`, or `fallback` if it is empty
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
 }
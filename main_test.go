@@ -3,31 +3,105 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"spse-role-poc/api/audit"
+	"spse-role-poc/api/fakeauth0"
 	"spse-role-poc/api/manager"
+	"spse-role-poc/api/middleware"
+	"spse-role-poc/api/policy"
+	"spse-role-poc/api/provision"
+	"spse-role-poc/api/router"
 
+	"github.com/auth0/go-auth0/management"
 	"github.com/joho/godotenv"
 )
 
+// Audience and roles claim of the access tokens issued by userToken
+const (
+	testAudience   = "https://spse-role-poc/"
+	testRolesClaim = "https://spse-role-poc/roles"
+	testOperator   = "auth0|operator" // see asOperator
+)
+
+// Fake tenant, directory and handlers under test, recreated by setup for every test
+var (
+	tenant *fakeauth0.Server
+	dir    manager.Directory
+	svc    *manager.Service
+)
+
+// Starts a fake Auth0 tenant, connects to it and provisions the role catalog of orgs.yaml
 func setup(t *testing.T) {
 	err := godotenv.Load()
 	if err != nil {
 		t.Fatal("Error loading .env file")
 	}
-	manager.ConnectAPI()
-	manager.RoleSetup()
+	pol, err := policy.Load("policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := provision.LoadRegistry("orgs.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant = fakeauth0.NewServer()
+	t.Cleanup(tenant.Close)
+
+	t.Setenv("AUTH0_DOMAIN", tenant.Domain())
+	t.Setenv("MGMT_CLIENT_ID", "") // static token, see TestClientCredentials
+	dir = manager.ConnectAPI(management.WithInsecure())
+	// access tokens of the API are issued and validated by the fake tenant
+	t.Setenv("AUTH0_DOMAIN", tenant.URL)
+	t.Setenv("AUTH0_AUDIENCE", testAudience)
+	t.Setenv("AUTH0_ROLES_CLAIM", testRolesClaim)
+	if _, err := provision.Sync(dir, reg, pol, false); err != nil {
+		t.Fatal(err)
+	}
+	svc = manager.NewService(dir, pol)
+	svc.Operators = []string{testOperator}
+}
+
+// Returns an access token of the user `sub` granted `scopes`, with the additional `claims`
+func userToken(sub string, claims map[string]interface{}, scopes ...string) string {
+	all := map[string]interface{}{"scope": strings.Join(scopes, " ")}
+	for claim, value := range claims {
+		all[claim] = value
+	}
+	return tenant.IssueUserToken(sub, testAudience, all, time.Hour)
+}
+
+// Returns an access token granted `scopes` of an Admin PPE of A:A1
+func adminToken(scopes ...string) string {
+	return userToken("auth0|admin", map[string]interface{}{testRolesClaim: []string{"A:A1:Admin PPE"}}, scopes...)
+}
+
+// Serves h to testOperator, whose grants are not checked against the delegation rules,
+// so that tests may create users with any roles
+func asOperator(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(manager.WithActor(r.Context(), testOperator)))
+	})
 }
 
 // Takes `email`, `password,` and `roles` as input, then tries the CreateUserHandler
 // to see if it created a new user as expected
 func testCreateHelper(t *testing.T, data map[string]interface{}, expectedStatus int) string {
-	server := httptest.NewServer(http.HandlerFunc(manager.CreateUserHandler))
+	server := httptest.NewServer(asOperator(svc.CreateUserHandler))
 	defer server.Close()
 
 	jsonData, err := json.Marshal(data)
@@ -77,9 +151,9 @@ func testCreateHelper(t *testing.T, data map[string]interface{}, expectedStatus
 // Takes `user_id`, and `roles` as input, then tries the AddRolesHandler or RewriteRolesHandler
 // to see if it updated the roles of the user as expected
 func testPatchHelper(t *testing.T, command string, data map[string]interface{}, expectedStatus int) {
-	server := httptest.NewServer(http.HandlerFunc(manager.AddRolesHandler))
+	server := httptest.NewServer(asOperator(svc.AddRolesHandler))
 	if command == "rewriteroles" {
-		server = httptest.NewServer(http.HandlerFunc(manager.RewriteRolesHandler))
+		server = httptest.NewServer(asOperator(svc.RewriteRolesHandler))
 	}
 
 	defer server.Close()
@@ -112,16 +186,48 @@ func testPatchHelper(t *testing.T, command string, data map[string]interface{},
 	}
 }
 
-// Check if the roles of user with <uid> in Auth0 has the same roles as expectedRoles
+// Sends `data` as the JSON body of a request `method` to `url`, with the access token
+// `token` unless it is empty and the additional `header`. The caller closes the response body.
+func testRequest(t *testing.T, method, url, token string, header map[string]string, data interface{}) *http.Response {
+	t.Helper()
+	var body io.Reader
+	if data != nil {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			t.Fatalf("Failed to marshal JSON data: %v", err)
+		}
+		body = bytes.NewBuffer(jsonData)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// Check if the roles of user with <uid> in the directory has the same roles as expectedRoles
 func checkRoles(t *testing.T, uid string, expectedRoles []string) error {
-	rolelist, err := manager.Auth0API.User.Roles(uid)
+	rolelist, err := dir.UserRoles(uid)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	actualRoles := make([]string, 0)
-	for _, role := range rolelist.Roles {
-		actualRoles = append(actualRoles, *role.Name)
+	for _, role := range rolelist {
+		actualRoles = append(actualRoles, role.Name)
 	}
 
 	sort.Strings(actualRoles)
@@ -146,7 +252,7 @@ func TestCreateEmptyRole(t *testing.T) {
 		"password": "Test123!",
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer dir.DeleteUser(uid)
 	checkRoles(t, uid, []string{})
 }
 
@@ -160,7 +266,7 @@ func TestCreateOnlyPengelola(t *testing.T) {
 		"roles":    queryRoles,
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer dir.DeleteUser(uid)
 	checkRoles(t, uid, expectedRoles)
 }
 
@@ -174,7 +280,7 @@ func TestCreateOnlyPengadaan(t *testing.T) {
 		"roles":    queryRoles,
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer dir.DeleteUser(uid)
 	checkRoles(t, uid, expectedRoles)
 }
 
@@ -188,7 +294,7 @@ func TestCreateOnlyAuditor(t *testing.T) {
 		"roles":    queryRoles,
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer dir.DeleteUser(uid)
 	checkRoles(t, uid, expectedRoles)
 }
 
@@ -229,7 +335,7 @@ func TestAddRoles(t *testing.T) {
 		"password": "Test123!",
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer dir.DeleteUser(uid)
 
 	expectedRoles := []string{"A:A1:Admin PPE", "A:A1:Admin Agency", "A:A1:Verifikator", "A:A1:Helpdesk"}
 	data = map[string]interface{}{
@@ -289,7 +395,7 @@ func TestRewriteRoles(t *testing.T) {
 		"password": "Test123!",
 	}
 	uid := testCreateHelper(t, data, http.StatusCreated)
-	defer manager.Auth0API.User.Delete(uid)
+	defer dir.DeleteUser(uid)
 
 	queryRoles := []string{"A:A1:Admin PPE", "A:A1:Admin Agency", "A:A1:Verifikator", "A:A1:Helpdesk"}
 	expectedRoles := queryRoles
@@ -321,37 +427,1129 @@ func TestRewriteRoles(t *testing.T) {
 	checkRoles(t, uid, expectedRoles)
 }
 
-// Extra Utility
-func deleteUser(email string) error {
-	userList, err := manager.Auth0API.User.List()
+func TestRateLimited(t *testing.T) {
+	setup(t)
+	data := map[string]interface{}{
+		"email":    "__test100@example.com",
+		"password": "Test123!",
+		"roles":    []string{"A:A1:PPK"},
+	}
+
+	// every call is answered with 429 once before it succeeds
+	tenant.RateLimit(3)
+	uid := testCreateHelper(t, data, http.StatusCreated)
+	defer dir.DeleteUser(uid)
+	checkRoles(t, uid, []string{"A:A1:PPK"})
+
+	if tenant.Requests() < 6 {
+		t.Fatalf("expected the rate limited requests to be retried, got %d requests", tenant.Requests())
+	}
+}
+
+func TestViolationResponse(t *testing.T) {
+	setup(t)
+	server := httptest.NewServer(asOperator(svc.CreateUserHandler))
+	defer server.Close()
+
+	res := testRequest(t, "POST", server.URL+"/create", "", nil, map[string]interface{}{
+		"email":    "__test100@example.com",
+		"password": "Test123!",
+		"roles":    []string{"A:A1:PPK", "A:A1:KUPBJ", "A:A2:PP"},
+	})
+	defer res.Body.Close()
+
+	var envelope struct {
+		Error struct {
+			Code       string              `json:"code"`
+			Violations []*policy.Violation `json:"violations"`
+		} `json:"error"`
+	}
+	err := json.NewDecoder(res.Body).Decode(&envelope)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal JSON data: %v", err)
+	}
+
+	if res.StatusCode != http.StatusBadRequest || envelope.Error.Code != manager.CodePolicyViolation {
+		t.Fatalf("unexpected response: %d %+v", res.StatusCode, envelope)
+	}
+	if len(envelope.Error.Violations) != 1 {
+		t.Fatalf("expected a single violation, got %+v", envelope.Error.Violations)
+	}
+	v := envelope.Error.Violations[0]
+	if v.Code != policy.CodeExclusive || v.Rule != "SOD-PP-PPK" || v.KLPD != "A" {
+		t.Fatalf("unexpected violation: %+v", v)
+	}
+	sort.Strings(v.Roles)
+	if strings.Join(v.Roles, ",") != "A:A1:PPK,A:A2:PP" {
+		t.Fatalf("unexpected offending roles: %v", v.Roles)
+	}
+}
+
+func TestCreateNormalizedRoles(t *testing.T) {
+	setup(t)
+	data := map[string]interface{}{
+		"email":    "__test100@example.com",
+		"password": "Test123!",
+		"roles":    []string{" a:a1:verifikator", "A : A1 : Helpdesk", "A:A1:Verifikator"},
+	}
+	uid := testCreateHelper(t, data, http.StatusCreated)
+	defer dir.DeleteUser(uid)
+	checkRoles(t, uid, []string{"A:A1:Helpdesk", "A:A1:Verifikator"})
+}
+
+func TestCatalogPagination(t *testing.T) {
+	setup(t)
+	// sort before the provisioned roles, so that they end up on later pages of the catalog
+	for i := 0; i < 250; i++ {
+		tenant.AddRole(fmt.Sprintf("0:S%03d:PP", i), "")
+	}
+
+	data := map[string]interface{}{
+		"email":    "__test100@example.com",
+		"password": "Test123!",
+		"roles":    []string{"B:A3:Auditor"},
+	}
+	uid := testCreateHelper(t, data, http.StatusCreated)
+	defer dir.DeleteUser(uid)
+	checkRoles(t, uid, []string{"B:A3:Auditor"})
+
+	// C:C1:PP follows the naming scheme, but is not in the catalog
+	data = map[string]interface{}{
+		"email":    "__test101@example.com",
+		"password": "Test123!",
+		"roles":    []string{"C:C1:PP"},
+	}
+	testCreateHelper(t, data, http.StatusBadRequest)
+}
+
+func TestRoleCatalogCache(t *testing.T) {
+	setup(t)
+	catalog := manager.NewCatalog(dir, time.Hour)
+
+	if _, err := catalog.Lookup([]string{"A:A1:PP"}); err != nil {
+		t.Fatal(err)
+	}
+	requests := tenant.Requests()
+	if _, err := catalog.Lookup([]string{"A:A1:PPK", "B:A2:Auditor"}); err != nil {
+		t.Fatal(err)
+	}
+	if tenant.Requests() != requests {
+		t.Fatalf("expected the second lookup to be served from memory, got %d requests", tenant.Requests()-requests)
+	}
+
+	// creating a role through the catalog invalidates it
+	if _, err := catalog.CreateRole("C:C1:PP", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := catalog.Lookup([]string{"C:C1:PP"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// roles created behind its back are only seen once it is invalidated
+	tenant.AddRole("C:C2:PP", "")
+	if _, err := catalog.Lookup([]string{"C:C2:PP"}); !errors.Is(err, manager.ErrRoleNotFound) {
+		t.Fatalf("expected role not found, got %v", err)
+	}
+	catalog.Invalidate()
+	if _, err := catalog.Lookup([]string{"C:C2:PP"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rate := expvar.Get("role_catalog").(*expvar.Map).Get("hit_rate").String(); rate == "0" {
+		t.Fatalf("expected a hit rate, got %s", rate)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	setup(t)
+	client := fakeauth0.Client{ID: "m2m", Secret: "secret", Scopes: manager.RequiredScopes, Lifetime: 24 * time.Hour}
+	tenant.SetClient(client)
+	t.Setenv("AUTH0_DOMAIN", tenant.URL)
+	t.Setenv("MGMT_CLIENT_ID", client.ID)
+	t.Setenv("MGMT_CLIENT_SECRET", client.Secret)
+
+	d, err := manager.Connect(management.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := d.ListRoles(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tenant.TokensIssued() != 1 {
+		t.Fatalf("expected the token to be reused, got %d tokens", tenant.TokensIssued())
+	}
+
+	// a revoked token is replaced and the request retried
+	tenant.RevokeTokens()
+	if _, err := d.ListRoles(); err != nil {
+		t.Fatal(err)
+	}
+	if tenant.TokensIssued() != 2 {
+		t.Fatalf("expected a new token after a 401, got %d tokens", tenant.TokensIssued())
+	}
+
+	// tokens about to expire are renewed before they are used
+	client.Lifetime = time.Minute
+	tenant.SetClient(client)
+	d, err = manager.Connect(management.WithInsecure())
 	if err != nil {
-		return err
+		t.Fatal(err)
+	}
+	issued := tenant.TokensIssued()
+	if _, err := d.ListRoles(); err != nil {
+		t.Fatal(err)
+	}
+	if tenant.TokensIssued() != issued+1 {
+		t.Fatalf("expected the short-lived token to be renewed, got %d new tokens", tenant.TokensIssued()-issued)
+	}
+
+	// the startup check reports the scopes the client is not granted
+	client.Scopes = []string{"read:users", "read:roles"}
+	tenant.SetClient(client)
+	_, err = manager.Connect(management.WithInsecure())
+	if !errors.Is(err, manager.ErrMissingScopes) || !strings.Contains(err.Error(), "delete:roles") {
+		t.Fatalf("expected missing scopes, got %v", err)
 	}
 
-	for _, user := range userList.Users {
-		if *user.Email == email {
-			manager.Auth0API.User.Delete(*user.ID)
-			return nil
+	t.Setenv("MGMT_CLIENT_SECRET", "wrong")
+	if _, err = manager.Connect(management.WithInsecure()); err == nil {
+		t.Fatal("expected wrong client credentials to be rejected")
+	}
+}
+
+func TestRewriteRolesDelta(t *testing.T) {
+	setup(t)
+	data := map[string]interface{}{
+		"email":    "__test100@example.com",
+		"password": "Test123!",
+		"roles":    []string{"A:A1:PPK", "A:A1:KUPBJ"},
+	}
+	uid := testCreateHelper(t, data, http.StatusCreated)
+	defer dir.DeleteUser(uid)
+
+	// assigning A:A1:Anggota Pokmil fails after A:A1:PPK was removed, which is restored
+	data = map[string]interface{}{
+		"id":    uid,
+		"roles": []string{"A:A1:Anggota Pokmil", "A:A1:KUPBJ"},
+	}
+	tenant.FailNext("POST", "/roles")
+	testPatchHelper(t, "rewriteroles", data, http.StatusInternalServerError)
+	checkRoles(t, uid, []string{"A:A1:KUPBJ", "A:A1:PPK"})
+
+	server := httptest.NewServer(asOperator(svc.RewriteRolesHandler))
+	defer server.Close()
+	res := testRequest(t, "POST", server.URL+"/rewriteroles", "", nil, data)
+	defer res.Body.Close()
+
+	var response struct {
+		Roles   []string `json:"roles"`
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK ||
+		strings.Join(response.Roles, ",") != "A:A1:Anggota Pokmil,A:A1:KUPBJ" ||
+		strings.Join(response.Added, ",") != "A:A1:Anggota Pokmil" ||
+		strings.Join(response.Removed, ",") != "A:A1:PPK" {
+		t.Fatalf("unexpected response: %d %+v", res.StatusCode, response)
+	}
+}
+
+func TestConcurrentAddRoles(t *testing.T) {
+	setup(t)
+	// a cached catalog, so that the requests only meet at the user's roles
+	pol := svc.Policy
+	svc := manager.NewService(manager.NewCatalog(dir, time.Hour), pol)
+	svc.Operators = []string{testOperator}
+	server := httptest.NewServer(asOperator(svc.AddRolesHandler))
+	defer server.Close()
+
+	for round := 0; round < 5; round++ {
+		uid := testCreateHelper(t, map[string]interface{}{
+			"email":    fmt.Sprintf("__test%d@example.com", 100+round),
+			"password": "Test123!",
+		}, http.StatusCreated)
+		defer dir.DeleteUser(uid)
+
+		// each request is valid on its own, PP and PPK together are not
+		tenant.SetLatency(20 * time.Millisecond)
+		statuses := make(chan int, 2)
+		for _, role := range []string{"A:A1:PP", "A:A2:PPK"} {
+			jsonData, err := json.Marshal(map[string]interface{}{"id": uid, "roles": []string{role}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest("PATCH", server.URL+"/addroles", bytes.NewBuffer(jsonData))
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				res.Body.Close()
+				statuses <- res.StatusCode
+			}()
+		}
+
+		ok := 0
+		for i := 0; i < 2; i++ {
+			if <-statuses == http.StatusOK {
+				ok++
+			}
+		}
+		tenant.SetLatency(0)
+		if ok != 1 {
+			t.Fatalf("expected exactly one request to succeed, got %d", ok)
+		}
+		if roles, _ := dir.UserRoles(uid); len(roles) != 1 {
+			t.Fatalf("expected a single role, got %v", roles)
 		}
 	}
-	return nil
 }
 
-func deleteAllTest() error {
-	userList, err := manager.Auth0API.User.List()
+func TestRoleSetVersion(t *testing.T) {
+	setup(t)
+	server := httptest.NewServer(router.New(svc))
+	defer server.Close()
+
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test100@example.com",
+		"password": "Test123!",
+		"roles":    []string{"A:A1:PPK"},
+	}, http.StatusCreated)
+	defer dir.DeleteUser(uid)
+
+	token := adminToken(middleware.ScopeUsersRead, middleware.ScopeUsersWrite)
+	send := func(method, path, ifMatch string, data interface{}) *http.Response {
+		var header map[string]string
+		if ifMatch != "" {
+			header = map[string]string{"If-Match": ifMatch}
+		}
+		res := testRequest(t, method, server.URL+path, token, header, data)
+		res.Body.Close()
+		return res
+	}
+
+	res := send("GET", "/users/"+url.PathEscape(uid)+"/roles", "", nil)
+	v1 := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || v1 == "" {
+		t.Fatalf("expected the roles with a version, got %d %q", res.StatusCode, v1)
+	}
+
+	res = send("PATCH", "/addroles", v1, map[string]interface{}{"id": uid, "roles": []string{"A:A1:KUPBJ"}})
+	v2 := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || v2 == "" || v2 == v1 {
+		t.Fatalf("expected a new version, got %d %q", res.StatusCode, v2)
+	}
+	if res = send("GET", "/users/"+url.PathEscape(uid)+"/roles", "", nil); res.Header.Get("ETag") != v2 {
+		t.Fatalf("expected version %s, got %s", v2, res.Header.Get("ETag"))
+	}
+
+	// an edit based on the first version is refused
+	rewrite := map[string]interface{}{"id": uid, "roles": []string{"A:A1:Anggota Pokmil"}}
+	if res = send("PATCH", "/rewriteroles", v1, rewrite); res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a stale version, got %d", res.StatusCode)
+	}
+	checkRoles(t, uid, []string{"A:A1:KUPBJ", "A:A1:PPK"})
+
+	if res = send("PATCH", "/rewriteroles", v2, rewrite); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the current version to be accepted, got %d", res.StatusCode)
+	}
+	checkRoles(t, uid, []string{"A:A1:Anggota Pokmil"})
+}
+
+func TestAuditLog(t *testing.T) {
+	setup(t)
+	sink, err := audit.OpenJSONL(filepath.Join(t.TempDir(), "audit.jsonl"))
 	if err != nil {
-		return err
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	svc.Audit = sink
+
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email":    "__test100@example.com",
+		"password": "Test123!",
+		"roles":    []string{"A:A1:PPK"},
+	}, http.StatusCreated)
+	defer dir.DeleteUser(uid)
+
+	// requests passing the role check carry the assigner
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := manager.WithAssignerRoles(manager.WithActor(r.Context(), "auth0|admin"), []string{"A:A2:Admin PPE"})
+		svc.AddRolesHandler(w, r.WithContext(ctx))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	res := testRequest(t, "POST", server.URL, "", nil, map[string]interface{}{"id": uid, "roles": []string{"A:A2:PP"}})
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected PP and PPK to be refused, got %d", res.StatusCode)
 	}
 
-	uid_to_be_deleted := make([]string, 0)
-	for _, user := range userList.Users {
-		if strings.Contains(*user.Email, "test") {
-			uid_to_be_deleted = append(uid_to_be_deleted, *user.ID)
+	api := httptest.NewServer(router.New(svc))
+	defer api.Close()
+	// the units are compared like the units of roles
+	res = testRequest(t, "GET", api.URL+"/audit?klpd=a&satuan_kerja=+a2&actor="+url.QueryEscape("auth0|admin"), userToken("auth0|auditor", nil, middleware.ScopeAuditRead), nil, nil)
+	defer res.Body.Close()
+	var response struct {
+		Events []*audit.Event `json:"events"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Events) != 1 {
+		t.Fatalf("expected the denied add, got %+v", response.Events)
+	}
+	e := response.Events[0]
+	if e.Action != audit.ActionAddRoles || e.Target != uid || e.Decision != audit.DecisionDeny ||
+		strings.Join(e.Before, ",") != "A:A1:PPK" || strings.Join(e.After, ",") != "A:A1:PPK,A:A2:PP" ||
+		len(e.Violations) != 1 || e.Violations[0].Rule != "SOD-PP-PPK" {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+
+	// the creation was recorded as the operator's
+	events, _ := sink.Query(audit.Filter{Actor: testOperator})
+	if len(events) != 1 || events[0].Action != audit.ActionCreateUser || events[0].Decision != audit.DecisionAllow || !events[0].Operator {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	setup(t)
+	api := httptest.NewServer(router.New(svc))
+	defer api.Close()
+
+	send := func(method, path string, dryRunHeader bool, data interface{}) (int, map[string]interface{}) {
+		var header map[string]string
+		if dryRunHeader {
+			header = map[string]string{"X-Dry-Run": "true"}
 		}
+		res := testRequest(t, method, api.URL+path, adminToken(middleware.ScopeUsersWrite), header, data)
+		defer res.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&body)
+		return res.StatusCode, body
 	}
 
-	for _, uid := range uid_to_be_deleted {
-		manager.Auth0API.User.Delete(uid)
+	create := map[string]interface{}{"email": "__test100@example.com", "password": "Test123!", "roles": []string{"A:A1:PPK"}}
+	status, body := send("POST", "/create?dry_run=true", false, create)
+	if status != http.StatusOK || body["dry_run"] != true || fmt.Sprint(body["roles"]) != "[A:A1:PPK]" {
+		t.Fatalf("unexpected dry run: %d %v", status, body)
+	}
+	// the user was not created, so the email is still free
+	uid := testCreateHelper(t, create, http.StatusCreated)
+	defer dir.DeleteUser(uid)
+
+	status, body = send("PATCH", "/rewriteroles", true, map[string]interface{}{"id": uid, "roles": []string{"A:A1:KUPBJ"}})
+	if status != http.StatusOK || fmt.Sprint(body["roles"], body["added"], body["removed"]) != "[A:A1:KUPBJ] [A:A1:KUPBJ] [A:A1:PPK]" {
+		t.Fatalf("unexpected dry run: %d %v", status, body)
+	}
+	status, body = send("PATCH", "/addroles?dry_run=1", false, map[string]interface{}{"id": uid, "roles": []string{"A:A1:KUPBJ"}})
+	if status != http.StatusOK || fmt.Sprint(body["roles"]) != "[A:A1:KUPBJ A:A1:PPK]" {
+		t.Fatalf("unexpected dry run: %d %v", status, body)
+	}
+	// violations are reported like for the actual request
+	if status, _ = send("PATCH", "/addroles?dry_run=true", false, map[string]interface{}{"id": uid, "roles": []string{"A:A1:PP"}}); status != http.StatusBadRequest {
+		t.Fatalf("expected the violation of the dry run, got %d", status)
+	}
+	checkRoles(t, uid, []string{"A:A1:PPK"})
+}
+
+func TestDecisions(t *testing.T) {
+	setup(t)
+	assigner := testCreateHelper(t, map[string]interface{}{
+		"email": "__test100@example.com", "password": "Test123!", "roles": []string{"A:A1:Admin PPE"},
+	}, http.StatusCreated)
+	defer dir.DeleteUser(assigner)
+	target := testCreateHelper(t, map[string]interface{}{
+		"email": "__test101@example.com", "password": "Test123!", "roles": []string{"A:A1:PPK"},
+	}, http.StatusCreated)
+	defer dir.DeleteUser(target)
+
+	// the assigner is the subject of the validated token, whose roles are resolved by the role check
+	actor := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := manager.WithActor(r.Context(), actor)
+		if actor != "" {
+			ctx = manager.WithAssignerRoles(ctx, []string{"A:A1:Admin PPE"})
+		}
+		svc.DecisionsHandler(w, r.WithContext(ctx))
+	}))
+	defer server.Close()
+
+	items := []map[string]string{
+		{"role": "A:A1:PP", "user_id": target},
+		{"role": "a:a1:kupbj", "user_id": target},
+		{"role": "A:A2:KUPBJ"},
+		{"role": "A1:PP"},
+		{"role": "C:C1:PP"},
+	}
+	data := map[string]interface{}{"items": items}
+	res := testRequest(t, "POST", server.URL, "", nil, data)
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected decisions without assigner to be refused, got %d", res.StatusCode)
+	}
+
+	actor = assigner
+	res = testRequest(t, "POST", server.URL, "", nil, data)
+	defer res.Body.Close()
+	var response struct {
+		Assigner  string `json:"assigner"`
+		Decisions []struct {
+			Decision string              `json:"decision"`
+			Reasons  []*policy.Violation `json:"reasons"`
+		} `json:"decisions"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Assigner != assigner || len(response.Decisions) != len(items) {
+		t.Fatalf("unexpected response: %+v", response)
+	}
+
+	want := []string{
+		"deny " + policy.CodeExclusive,
+		"allow",
+		"deny " + policy.CodeGrantDenied,
+		"deny " + policy.CodeInvalidRole,
+		"deny " + policy.CodeGrantDenied + " " + manager.CodeRoleNotFound,
+	}
+	for i, d := range response.Decisions {
+		got := d.Decision
+		for _, reason := range d.Reasons {
+			got += " " + reason.Code
+		}
+		if got != want[i] {
+			t.Fatalf("%v: expected %q, got %q", items[i], want[i], got)
+		}
+	}
+}
+
+func TestGrantableRoles(t *testing.T) {
+	setup(t)
+	assigner := testCreateHelper(t, map[string]interface{}{
+		"email": "__test100@example.com", "password": "Test123!", "roles": []string{"A:A1:Admin Agency"},
+	}, http.StatusCreated)
+	defer dir.DeleteUser(assigner)
+	target := testCreateHelper(t, map[string]interface{}{
+		"email": "__test101@example.com", "password": "Test123!", "roles": []string{"A:A1:PPK"},
+	}, http.StatusCreated)
+	defer dir.DeleteUser(target)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := manager.WithAssignerRoles(manager.WithActor(r.Context(), assigner), []string{"A:A1:Admin Agency"})
+		svc.GrantableRolesHandler(w, r.WithContext(ctx))
+	}))
+	defer server.Close()
+
+	grantable := func(query string) string {
+		res, err := http.Get(server.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var response struct {
+			KLPD []struct {
+				Code        string `json:"code"`
+				SatuanKerja []struct {
+					Code  string `json:"code"`
+					Roles []struct {
+						Function string `json:"function"`
+					} `json:"roles"`
+				} `json:"satuan_kerja"`
+			} `json:"klpd"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		groups := make([]string, 0)
+		for _, klpd := range response.KLPD {
+			for _, satker := range klpd.SatuanKerja {
+				functions := make([]string, 0)
+				for _, role := range satker.Roles {
+					functions = append(functions, role.Function)
+				}
+				groups = append(groups, klpd.Code+":"+satker.Code+"="+strings.Join(functions, ","))
+			}
+		}
+		return strings.Join(groups, " ")
+	}
+
+	// Admin Agency grants within its own satuan kerja
+	if got := grantable(""); got != "A:A1=Anggota Pokmil,Helpdesk,KUPBJ,PP,PPK,Verifikator" {
+		t.Fatalf("unexpected grantable roles: %s", got)
+	}
+	// PPK excludes itself, PP and the roles of other divisions
+	if got := grantable("?user_id=" + url.QueryEscape(target)); got != "A:A1=Anggota Pokmil,KUPBJ" {
+		t.Fatalf("unexpected grantable roles for the target: %s", got)
+	}
+}
+
+func TestRoleHolders(t *testing.T) {
+	setup(t)
+	users := make(map[string]string) // user id -> email
+	for i, rolename := range []string{"A:A1:Admin PPE", "A:A1:Admin Agency", "A:A2:Admin PPE", "A:A1:PPK", "A:*:Admin PPE"} {
+		email := fmt.Sprintf("__test%d@example.com", 110+i)
+		uid := testCreateHelper(t, map[string]interface{}{
+			"email": email, "password": "Test123!", "roles": []string{rolename},
+		}, http.StatusCreated)
+		users[uid] = email
+	}
+	// more holders than fit on a page of the Management API, and than it returns with page and per_page
+	tenant.SetOffsetLimit(100)
+	roles, err := svc.Catalog.Lookup([]string{"A:A1:PPK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 120; i++ {
+		uid, err := dir.CreateUser(fmt.Sprintf("__bulk%d@example.com", i), "Test123!")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dir.AssignRoles(uid, roles); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(svc.RoleHoldersHandler))
+	defer server.Close()
+
+	type holders struct {
+		Role   manager.Role   `json:"role"`
+		Grants []string       `json:"grants"`
+		Users  []manager.User `json:"users"`
+	}
+	lookup := func(query string, expectedStatus int) (h, g []holders) {
+		res, err := http.Get(server.URL + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != expectedStatus {
+			t.Fatalf("%s: unexpected status code: got %d, want %d", query, res.StatusCode, expectedStatus)
+		}
+		var response struct {
+			Holders  []holders `json:"holders"`
+			Granters []holders `json:"granters"`
+		}
+		json.NewDecoder(res.Body).Decode(&response)
+		return response.Holders, response.Granters
+	}
+	emails := func(list []manager.User) string {
+		result := make([]string, 0, len(list))
+		for _, user := range list {
+			result = append(result, user.Email)
+		}
+		sort.Strings(result)
+		return strings.Join(result, ",")
+	}
+
+	h, g := lookup("role="+url.QueryEscape("a:a1:ppk"), http.StatusOK)
+	if len(h) != 1 || h[0].Role.Name != "A:A1:PPK" || len(h[0].Users) != 121 {
+		t.Fatalf("expected the 121 holders of A:A1:PPK, got %+v", h)
+	}
+	got := make([]string, 0)
+	for _, granter := range g {
+		got = append(got, granter.Role.Name+"="+emails(granter.Users))
+	}
+	// KLPD-wide granters grant in every satuan kerja of the KLPD
+	want := "A:*:Admin Agency= A:*:Admin PPE=__test114@example.com A:A1:Admin Agency=__test111@example.com A:A1:Admin PPE=__test110@example.com"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("expected granters %s, got %s", want, strings.Join(got, " "))
+	}
+
+	// every role of the satuan kerja, and the roles granting any of them
+	h, g = lookup("satuan_kerja="+url.QueryEscape("A:A2"), http.StatusOK)
+	if len(h) != 9 {
+		t.Fatalf("expected every role of A:A2, got %d", len(h))
+	}
+	if len(g) != 4 || g[3].Role.Name != "A:A2:Admin PPE" || emails(g[3].Users) != "__test112@example.com" || len(g[3].Grants) != 7 {
+		t.Fatalf("unexpected granters of A:A2: %+v", g)
+	}
+
+	lookup("", http.StatusBadRequest)
+	// the KLPD-wide roles
+	if h, _ = lookup("satuan_kerja="+url.QueryEscape("A:*"), http.StatusOK); len(h) != 2 || emails(h[1].Users) != "__test114@example.com" {
+		t.Fatalf("unexpected holders of A:*: %+v", h)
+	}
+
+	lookup("satuan_kerja=A", http.StatusBadRequest)
+	lookup("role="+url.QueryEscape("C:C1:PP"), http.StatusBadRequest)
+}
+
+func TestValidateRolesToken(t *testing.T) {
+	setup(t)
+	server := httptest.NewServer(router.New(svc))
+	defer server.Close()
+
+	assigner := testCreateHelper(t, map[string]interface{}{
+		"email": "__test120@example.com", "password": "Test123!", "roles": []string{"A:A1:Admin Agency"},
+	}, http.StatusCreated)
+
+	n := 0
+	create := func(token string, roles []string, expectedStatus int) {
+		n++
+		res := testRequest(t, "POST", server.URL+"/create-protected", token, nil, map[string]interface{}{
+			"email": fmt.Sprintf("__test%d@example.com", 120+n), "password": "Test123!", "roles": roles,
+		})
+		defer res.Body.Close()
+		if res.StatusCode != expectedStatus {
+			body, _ := ioutil.ReadAll(res.Body)
+			t.Fatalf("%v: unexpected status code: got %d, want %d: %s", roles, res.StatusCode, expectedStatus, body)
+		}
+	}
+
+	create("", []string{"A:A1:PPK"}, http.StatusUnauthorized)
+	create(tenant.IssueUserToken(assigner, "https://other/", map[string]interface{}{"scope": middleware.ScopeUsersWrite}, time.Hour), []string{"A:A1:PPK"}, http.StatusUnauthorized)
+
+	// the roles claim takes precedence over the directory
+	claimed := userToken(assigner, map[string]interface{}{testRolesClaim: []string{"A:A1:Admin PPE"}}, middleware.ScopeUsersWrite, middleware.ScopeRolesRead)
+	create(claimed, []string{"A:A1:Admin Agency"}, http.StatusCreated)
+
+	// and the decisions agree with the role check
+	res := testRequest(t, "POST", server.URL+"/v1/decisions", claimed, nil, map[string]interface{}{"items": []map[string]string{{"role": "A:A1:Admin Agency"}}})
+	var response struct {
+		Decisions []struct {
+			Decision string `json:"decision"`
+		} `json:"decisions"`
+	}
+	json.NewDecoder(res.Body).Decode(&response)
+	res.Body.Close()
+	if len(response.Decisions) != 1 || response.Decisions[0].Decision != manager.DecisionAllow {
+		t.Fatalf("expected the decision of the claimed roles, got %+v", response)
+	}
+
+	// without the claim the roles are looked up once per token
+	token := userToken(assigner, nil, middleware.ScopeUsersWrite)
+	create(token, []string{"A:A1:Admin Agency"}, http.StatusForbidden)
+	create(token, []string{"A:A1:PPK"}, http.StatusCreated)
+
+	if err := dir.RemoveRoles(assigner, mustLookup(t, "A:A1:Admin Agency")); err != nil {
+		t.Fatal(err)
+	}
+	create(token, []string{"A:A1:KUPBJ"}, http.StatusCreated)
+	create(userToken(assigner, nil, middleware.ScopeUsersWrite), []string{"A:A1:KUPBJ"}, http.StatusForbidden)
+}
+
+func mustLookup(t *testing.T, rolenames ...string) []manager.Role {
+	t.Helper()
+	roles, err := svc.Catalog.Lookup(rolenames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return roles
+}
+
+func TestRequireScope(t *testing.T) {
+	setup(t)
+	server := httptest.NewServer(router.New(svc))
+	defer server.Close()
+
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email": "__test100@example.com", "password": "Test123!", "roles": []string{"A:A1:PPK"},
+	}, http.StatusCreated)
+
+	send := func(method, path, token string, data interface{}) (int, string) {
+		res := testRequest(t, method, server.URL+path, token, nil, data)
+		defer res.Body.Close()
+		var body struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		return res.StatusCode, body.Error.Code
+	}
+
+	path := "/users/" + url.PathEscape(uid) + "/roles"
+	add := map[string]interface{}{"id": uid, "roles": []string{"A:A1:KUPBJ"}}
+	tests := []struct {
+		method, path string
+		token        string
+		data         interface{}
+		status       int
+		code         string
+	}{
+		{"GET", path, "", nil, http.StatusUnauthorized, manager.CodeUnauthorized},
+		{"GET", path, "not a jwt", nil, http.StatusUnauthorized, manager.CodeUnauthorized},
+		{"GET", path, adminToken(middleware.ScopeUsersWrite), nil, http.StatusForbidden, manager.CodeForbidden},
+		{"GET", path, adminToken(middleware.ScopeUsersRead), nil, http.StatusOK, ""},
+		{"PATCH", "/addroles", adminToken(middleware.ScopeUsersRead), add, http.StatusForbidden, manager.CodeForbidden},
+		{"PATCH", "/addroles", adminToken(middleware.ScopeUsersRead, middleware.ScopeUsersWrite), add, http.StatusOK, ""},
+		{"DELETE", "/deleteuser", adminToken(middleware.ScopeUsersWrite), map[string]string{"id": uid}, http.StatusForbidden, manager.CodeForbidden},
+		{"GET", "/audit", adminToken(middleware.ScopeUsersRead), nil, http.StatusForbidden, manager.CodeForbidden},
+		{"GET", "/debug/vars", "", nil, http.StatusUnauthorized, manager.CodeUnauthorized},
+		{"GET", "/debug/vars", adminToken(middleware.ScopeAuditRead), nil, http.StatusForbidden, manager.CodeForbidden},
+		{"GET", "/debug/vars", adminToken(middleware.ScopeMetricsRead), nil, http.StatusOK, ""},
+		{"GET", "/", "", nil, http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		status, code := send(test.method, test.path, test.token, test.data)
+		if status != test.status || code != test.code {
+			t.Fatalf("%s %s: expected %d %q, got %d %q", test.method, test.path, test.status, test.code, status, code)
+		}
+	}
+	checkRoles(t, uid, []string{"A:A1:KUPBJ", "A:A1:PPK"})
+}
+
+func TestRemovalAuthorization(t *testing.T) {
+	setup(t)
+	server := httptest.NewServer(router.New(svc))
+	defer server.Close()
+
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email": "__test100@example.com", "password": "Test123!", "roles": []string{"A:A1:Admin Agency"},
+	}, http.StatusCreated)
+
+	agency := userToken("auth0|agency", map[string]interface{}{testRolesClaim: []string{"A:A1:Admin Agency"}}, middleware.ScopeUsersWrite)
+	rewrite := func(token string, roles []string, expectedStatus int) []string {
+		res := testRequest(t, "PATCH", server.URL+"/rewriteroles", token, nil, map[string]interface{}{"id": uid, "roles": roles})
+		defer res.Body.Close()
+		if res.StatusCode != expectedStatus {
+			t.Fatalf("%v: unexpected status code: got %d, want %d", roles, res.StatusCode, expectedStatus)
+		}
+		var body struct {
+			Error struct {
+				Violations []*policy.Violation `json:"violations"`
+			} `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		codes := make([]string, 0)
+		for _, v := range body.Error.Violations {
+			codes = append(codes, v.Code+" "+strings.Join(v.Roles, ","))
+		}
+		return codes
+	}
+
+	// roles kept by a rewrite are not checked, only the delta
+	rewrite(agency, []string{"A:A1:Admin Agency", "A:A1:Helpdesk"}, http.StatusOK)
+	checkRoles(t, uid, []string{"A:A1:Admin Agency", "A:A1:Helpdesk"})
+
+	// an Admin Agency may not grant Admin Agency, so it may not remove it either
+	codes := rewrite(agency, []string{"A:A1:Verifikator"}, http.StatusForbidden)
+	if strings.Join(codes, ";") != policy.CodeRevokeDenied+" A:A1:Admin Agency" {
+		t.Fatalf("expected the removal of Admin Agency to be refused, got %v", codes)
+	}
+	checkRoles(t, uid, []string{"A:A1:Admin Agency", "A:A1:Helpdesk"})
+
+	// the Admin PPE of the satuan kerja may
+	rewrite(adminToken(middleware.ScopeUsersWrite), []string{"A:A1:Verifikator"}, http.StatusOK)
+	checkRoles(t, uid, []string{"A:A1:Verifikator"})
+
+	// deleting a user removes every role the user holds
+	other := testCreateHelper(t, map[string]interface{}{
+		"email": "__test101@example.com", "password": "Test123!", "roles": []string{"A:A1:Admin Agency"},
+	}, http.StatusCreated)
+	remove := func(token, uid string, expectedStatus int) {
+		res := testRequest(t, "DELETE", server.URL+"/deleteuser", token, nil, map[string]string{"id": uid})
+		res.Body.Close()
+		if res.StatusCode != expectedStatus {
+			t.Fatalf("delete %s: unexpected status code: got %d, want %d", uid, res.StatusCode, expectedStatus)
+		}
+	}
+	agency = userToken("auth0|agency", map[string]interface{}{testRolesClaim: []string{"A:A1:Admin Agency"}}, middleware.ScopeUsersDelete)
+	remove(agency, other, http.StatusForbidden)
+	checkRoles(t, other, []string{"A:A1:Admin Agency"})
+	remove(agency, uid, http.StatusOK)
+	remove(adminToken(middleware.ScopeUsersDelete), other, http.StatusOK)
+}
+
+func TestUnmanagedRoles(t *testing.T) {
+	setup(t)
+	server := httptest.NewServer(router.New(svc))
+	defer server.Close()
+
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email": "__test100@example.com", "password": "Test123!", "roles": []string{"A:A1:PPK"},
+	}, http.StatusCreated)
+	// a role outside of the naming scheme, e.g. one of another application of the tenant
+	legacy := manager.Role{ID: tenant.AddRole("Legacy Viewer", "not managed by the policy"), Name: "Legacy Viewer"}
+	if err := dir.AssignRoles(uid, []manager.Role{legacy}); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrite := func(token string, header map[string]string, roles []string) map[string]interface{} {
+		res := testRequest(t, "PATCH", server.URL+"/rewriteroles", token, header, map[string]interface{}{"id": uid, "roles": roles})
+		defer res.Body.Close()
+		var body map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%v: unexpected status code: got %d, want %d: %v", roles, res.StatusCode, http.StatusOK, body)
+		}
+		return body
+	}
+
+	// the role is neither checked nor removed by a rewrite
+	agency := userToken("auth0|agency", map[string]interface{}{testRolesClaim: []string{"A:A1:Admin Agency"}}, middleware.ScopeUsersWrite, middleware.ScopeUsersDelete)
+	body := rewrite(agency, map[string]string{"X-Dry-Run": "true"}, []string{"A:A1:KUPBJ"})
+	if fmt.Sprint(body["roles"], body["removed"]) != "[A:A1:KUPBJ Legacy Viewer] [A:A1:PPK]" {
+		t.Fatalf("unexpected dry run: %v", body)
+	}
+	rewrite(agency, nil, []string{"A:A1:KUPBJ"})
+	checkRoles(t, uid, []string{"A:A1:KUPBJ", "Legacy Viewer"})
+	testPatchHelper(t, "rewriteroles", map[string]interface{}{"id": uid, "roles": []string{"A:A1:PPK"}}, http.StatusOK)
+	checkRoles(t, uid, []string{"A:A1:PPK", "Legacy Viewer"})
+
+	// nor does it stand in the way of deleting the user
+	res := testRequest(t, "DELETE", server.URL+"/deleteuser", agency, nil, map[string]string{"id": uid})
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the user to be deleted, got %d", res.StatusCode)
+	}
+}
+
+func TestKLPDWideAdmin(t *testing.T) {
+	setup(t)
+	server := httptest.NewServer(router.New(svc))
+	defer server.Close()
+
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email": "__test100@example.com", "password": "Test123!", "roles": []string{"A:A2:PPK"},
+	}, http.StatusCreated)
+	defer dir.DeleteUser(uid)
+
+	// an Admin PPE of every satuan kerja of A, whose roles are looked up in the directory
+	admin := testCreateHelper(t, map[string]interface{}{
+		"email": "__test101@example.com", "password": "Test123!", "roles": []string{"a:*:admin ppe"},
+	}, http.StatusCreated)
+	defer dir.DeleteUser(admin)
+	checkRoles(t, admin, []string{"A:*:Admin PPE"})
+	token := userToken(admin, nil, middleware.ScopeUsersWrite, middleware.ScopeRolesRead)
+	send := func(method, path string, data interface{}, expectedStatus int) *http.Response {
+		res := testRequest(t, method, server.URL+path, token, nil, data)
+		if res.StatusCode != expectedStatus {
+			res.Body.Close()
+			t.Fatalf("%s %s %v: unexpected status code: got %d, want %d", method, path, data, res.StatusCode, expectedStatus)
+		}
+		return res
+	}
+
+	// it grants in any satuan kerja of A, but not in B
+	send("PATCH", "/addroles", map[string]interface{}{"id": uid, "roles": []string{"A:A3:KUPBJ"}}, http.StatusOK).Body.Close()
+	send("PATCH", "/addroles", map[string]interface{}{"id": uid, "roles": []string{"B:A1:KUPBJ"}}, http.StatusForbidden).Body.Close()
+	checkRoles(t, uid, []string{"A:A2:PPK", "A:A3:KUPBJ"})
+
+	items := []map[string]string{
+		{"role": "A:A1:Verifikator"},
+		{"role": "A:*:Admin Agency"},
+		{"role": "A:*:PP"},
+		{"role": "A:A1:PP", "user_id": uid},
+	}
+	res := send("POST", "/v1/decisions", map[string]interface{}{"items": items}, http.StatusOK)
+	defer res.Body.Close()
+	var response struct {
+		Decisions []struct {
+			Decision string              `json:"decision"`
+			Reasons  []*policy.Violation `json:"reasons"`
+		} `json:"decisions"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"allow",
+		"allow",
+		"deny " + policy.CodeInvalidRole,
+		"deny " + policy.CodeExclusive,
+	}
+	if len(response.Decisions) != len(want) {
+		t.Fatalf("unexpected response: %+v", response)
+	}
+	for i, d := range response.Decisions {
+		got := d.Decision
+		for _, reason := range d.Reasons {
+			got += " " + reason.Code
+		}
+		if got != want[i] {
+			t.Fatalf("%v: expected %q, got %q", items[i], want[i], got)
+		}
+	}
+}
+
+func TestCreateAuthorization(t *testing.T) {
+	setup(t)
+	data := map[string]interface{}{
+		"email": "__test100@example.com", "password": "Test123!", "roles": []string{"A:A1:Admin PPE", "A:*:Admin PPE"},
+	}
+	create := func(handler http.Handler, path, token string) int {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		res := testRequest(t, "POST", server.URL+path, token, nil, data)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// a user without roles may not grant any role, on either route
+	token := userToken("auth0|nobody", map[string]interface{}{testRolesClaim: []string{}}, middleware.ScopeUsersWrite)
+	for _, path := range []string{"/create", "/create-protected"} {
+		if status := create(router.New(svc), path, token); status != http.StatusForbidden {
+			t.Fatalf("%s: expected 403, got %d", path, status)
+		}
+	}
+	// neither may a request which carries no assigner roles at all
+	if status := create(http.HandlerFunc(svc.CreateUserHandler), "/create", ""); status != http.StatusForbidden {
+		t.Fatalf("expected a request without assigner roles to be refused, got %d", status)
+	}
+}
+
+func TestSelfModification(t *testing.T) {
+	setup(t)
+	sink, err := audit.OpenJSONL(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	svc.Audit = sink
+
+	uid := testCreateHelper(t, map[string]interface{}{
+		"email": "__test100@example.com", "password": "Test123!", "roles": []string{"A:A1:Admin PPE"},
+	}, http.StatusCreated)
+	self := userToken(uid, map[string]interface{}{testRolesClaim: []string{"A:A1:Admin PPE"}}, middleware.ScopeUsersWrite)
+	server := httptest.NewServer(router.New(svc))
+	defer server.Close()
+
+	add := func(mode, query, approval string, roles []string, expectedStatus int) string {
+		svc.Policy.SelfModification = mode
+		var header map[string]string
+		if approval != "" {
+			header = map[string]string{manager.ApprovalHeader: approval}
+		}
+		res := testRequest(t, "PATCH", server.URL+"/addroles"+query, self, header, map[string]interface{}{"id": uid, "roles": roles})
+		defer res.Body.Close()
+		var body struct {
+			Error struct {
+				Violations []*policy.Violation `json:"violations"`
+			} `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		if res.StatusCode != expectedStatus {
+			t.Fatalf("%s %v: unexpected status code: got %d, want %d: %+v", mode, roles, res.StatusCode, expectedStatus, body)
+		}
+		if len(body.Error.Violations) == 0 {
+			return ""
+		}
+		return body.Error.Violations[0].Code
+	}
+	// the approver approves the change with their own token
+	approve := func(sub, role string, change map[string]interface{}, expectedStatus int) string {
+		token := userToken(sub, map[string]interface{}{testRolesClaim: []string{role}}, middleware.ScopeUsersWrite)
+		res := testRequest(t, "POST", server.URL+"/v1/approvals", token, nil, change)
+		defer res.Body.Close()
+		var body struct {
+			ID string `json:"approval_id"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != expectedStatus {
+			t.Fatalf("%s %v: unexpected status code: got %d, want %d", sub, change, res.StatusCode, expectedStatus)
+		}
+		return body.ID
+	}
+
+	verifikator := []string{"A:A1:Verifikator"}
+	if code := add(policy.SelfModificationDeny, "", "", verifikator, http.StatusForbidden); code != policy.CodeSelfModification {
+		t.Fatalf("expected %s, got %s", policy.CodeSelfModification, code)
+	}
+
+	// the approver is another user allowed to make the change
+	change := map[string]interface{}{"user_id": uid, "add": verifikator}
+	approve(uid, "A:A1:Admin PPE", change, http.StatusForbidden)
+	approve("auth0|helpdesk", "A:A1:Helpdesk", change, http.StatusForbidden)
+	approval := approve("auth0|agency", "A:A1:Admin Agency", change, http.StatusCreated)
+
+	// the approval is only redeemed by the approved change
+	tests := []struct {
+		approval string
+		roles    []string
+	}{
+		{"", verifikator},
+		{"unknown", verifikator},
+		{approval, []string{"A:A1:Helpdesk"}},
+		{approval, []string{"A:A1:Verifikator", "A:A1:Helpdesk"}},
+	}
+	for _, test := range tests {
+		if code := add(policy.SelfModificationApproval, "", test.approval, test.roles, http.StatusForbidden); code != policy.CodeSelfModification {
+			t.Fatalf("%v: expected %s, got %s", test.roles, policy.CodeSelfModification, code)
+		}
+	}
+	checkRoles(t, uid, []string{"A:A1:Admin PPE"})
+
+	// a dry run only checks it, the change uses it up
+	add(policy.SelfModificationApproval, "?dry_run=true", approval, verifikator, http.StatusOK)
+	add(policy.SelfModificationApproval, "", approval, verifikator, http.StatusOK)
+	checkRoles(t, uid, []string{"A:A1:Admin PPE", "A:A1:Verifikator"})
+	testPatchHelper(t, "rewriteroles", map[string]interface{}{"id": uid, "roles": []string{"A:A1:Admin PPE"}}, http.StatusOK)
+	if code := add(policy.SelfModificationApproval, "", approval, verifikator, http.StatusForbidden); code != policy.CodeSelfModification {
+		t.Fatalf("expected the used approval to be refused, got %s", code)
+	}
+
+	add(policy.SelfModificationAllow, "", "", []string{"A:A1:Helpdesk"}, http.StatusOK)
+	checkRoles(t, uid, []string{"A:A1:Admin PPE", "A:A1:Helpdesk"})
+
+	// newest first
+	events, _ := sink.Query(audit.Filter{Actor: uid})
+	approvers := make([]string, 0)
+	for _, e := range events {
+		if e.Decision == audit.DecisionAllow {
+			approvers = append(approvers, e.Approver)
+		}
+	}
+	if strings.Join(approvers, ",") != ",auth0|agency" {
+		t.Fatalf("expected the approver to be recorded, got %q", approvers)
+	}
+	// refusals are recorded like any other decision
+	refused := make([]string, 0)
+	for _, e := range events {
+		if e.Decision == audit.DecisionDeny && e.Violations[0].Code == policy.CodeSelfModification {
+			refused = append(refused, e.Violations[0].Code)
+		}
+	}
+	if len(refused) != 2+len(tests) {
+		t.Fatalf("expected the refusals to be recorded, got %v", refused)
+	}
+
+	// the decisions answer the assigner's own roles the same way
+	decide := func(mode string) string {
+		svc.Policy.SelfModification = mode
+		server := httptest.NewServer(router.New(svc))
+		defer server.Close()
+
+		token := userToken(uid, map[string]interface{}{testRolesClaim: []string{"A:A1:Admin PPE"}}, middleware.ScopeRolesRead)
+		res := testRequest(t, "POST", server.URL+"/v1/decisions", token, nil, map[string]interface{}{"items": []map[string]string{{"role": "A:A1:Admin Agency", "user_id": uid}}})
+		defer res.Body.Close()
+		var response struct {
+			Decisions []struct {
+				Decision string              `json:"decision"`
+				Reasons  []*policy.Violation `json:"reasons"`
+			} `json:"decisions"`
+		}
+		json.NewDecoder(res.Body).Decode(&response)
+		got := response.Decisions[0].Decision
+		for _, reason := range response.Decisions[0].Reasons {
+			got += " " + reason.Code
+		}
+		return got
+	}
+	for mode, want := range map[string]string{
+		policy.SelfModificationDeny:     "deny " + policy.CodeSelfModification,
+		policy.SelfModificationApproval: "deny " + policy.CodeSelfModification,
+		policy.SelfModificationAllow:    "allow",
+	} {
+		if got := decide(mode); got != want {
+			t.Fatalf("%s: expected %q, got %q", mode, want, got)
+		}
 	}
-	return nil
 }